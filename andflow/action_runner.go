@@ -1,6 +1,7 @@
 package andflow
 
 import (
+	"context"
 	"strings"
 
 	"github.com/dop251/goja"
@@ -28,6 +29,28 @@ type ActionRunner interface {
 	Execute(s *Session, param *ActionParam, state *ActionStateModel) (Result, error)
 }
 
+// 支持上下文的节点执行器，上下文带有执行时效、运行时ID和节点ID，超时或者停止的时候结束
+type ContextActionRunner interface {
+	ActionRunner
+	ExecuteContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error)
+}
+
+// 将节点执行器转换为支持上下文的执行器，不支持上下文的执行器忽略上下文
+func ToContextActionRunner(runner ActionRunner) ContextActionRunner {
+	if r, ok := runner.(ContextActionRunner); ok {
+		return r
+	}
+	return &contextActionRunnerAdapter{runner}
+}
+
+type contextActionRunnerAdapter struct {
+	ActionRunner
+}
+
+func (a *contextActionRunnerAdapter) ExecuteContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	return a.Execute(s, param, state)
+}
+
 func RegistActionRunner(name string, runner ActionRunner) {
 	actionRunnerMap[name] = runner
 }
@@ -66,6 +89,10 @@ func (a *ScriptActionRunner) Properties() []Prop {
 }
 
 func (a *ScriptActionRunner) Execute(s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	return a.ExecuteContext(s.GetActionContext(param), s, param, state)
+}
+
+func (a *ScriptActionRunner) ExecuteContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
 
 	action := s.GetFlow().GetAction(param.ActionId)
 
@@ -103,6 +130,9 @@ func (a *ScriptActionRunner) Execute(s *Session, param *ActionParam, state *Acti
 
 	SetCommonActionScriptFunc(rts, s, param, state)
 
+	stopInterrupt := InterruptScriptOnDone(ctx, rts)
+	defer stopInterrupt()
+
 	script := "function $exec(){\n" + sc + "\n}\n $exec();\n"
 	val, err := rts.RunString(script)
 	if err != nil {
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package andflow
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// 命令在单独的进程组中执行，结束时可以一起结束子进程启动的进程
+func setCmdProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// 结束命令的整个进程组
+func killCmdProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
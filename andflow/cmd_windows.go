@@ -0,0 +1,17 @@
+//go:build windows
+
+package andflow
+
+import (
+	"os/exec"
+)
+
+func setCmdProcessGroup(cmd *exec.Cmd) {
+}
+
+// 结束命令进程，管道在返回前关闭，不等待子进程启动的进程
+func killCmdProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
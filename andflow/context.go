@@ -0,0 +1,37 @@
+package andflow
+
+import "context"
+
+type contextKey string
+
+const (
+	contextKeyRuntimeId   contextKey = "runtime_id"
+	contextKeyActionId    contextKey = "action_id"
+	contextKeyPreActionId contextKey = "pre_action_id"
+)
+
+// 获取上下文中的运行时ID
+func GetContextRuntimeId(ctx context.Context) string {
+	return getContextString(ctx, contextKeyRuntimeId)
+}
+
+// 获取上下文中的节点ID
+func GetContextActionId(ctx context.Context) string {
+	return getContextString(ctx, contextKeyActionId)
+}
+
+// 获取上下文中的上一个节点ID
+func GetContextPreActionId(ctx context.Context) string {
+	return getContextString(ctx, contextKeyPreActionId)
+}
+
+func getContextString(ctx context.Context, key contextKey) string {
+	if ctx == nil {
+		return ""
+	}
+	val, ok := ctx.Value(key).(string)
+	if !ok {
+		return ""
+	}
+	return val
+}
@@ -1,5 +1,7 @@
 package andflow
 
+import "strings"
+
 const (
 	// 流程节点样式
 	THEME_DEFAULT = "flow_theme_default" //默认样式
@@ -12,6 +14,25 @@ const (
 	LINK_TYPE_STRAIGHT     = "Straight"
 	LINK_TYPE_BEZIER       = "Bezier"
 	LINK_TYPE_STATEMACHINE = "StateMachine"
+
+	//节点汇聚方式
+	COLLECT_MODE_ALL     = "all"     //所有路径都有结果后执行
+	COLLECT_MODE_ANY     = "any"     //任意一个路径到达都执行
+	COLLECT_MODE_COUNT   = "count"   //通过的路径达到指定数量后执行
+	COLLECT_MODE_FIRST   = "first"   //第一个通过的路径到达后执行，其余路径忽略
+	COLLECT_MODE_TIMEOUT = "timeout" //所有路径都有结果或者等待超时后执行
+
+	//节点执行后的路由方式
+	GATEWAY_PARALLEL  = "parallel"  //所有满足条件的路径都执行，默认
+	GATEWAY_EXCLUSIVE = "exclusive" //按照顺序只执行第一个满足条件的路径，都不满足时执行默认路径
+
+	//连接线的触发条件
+	LINK_ON_SUCCESS = "success" //源节点执行成功时执行，默认
+	LINK_ON_ERROR   = "error"   //源节点执行失败时执行
+
+	//节点或者组的循环方式
+	LOOP_WHILE = "while" //每次执行前判断循环条件，满足时执行
+	LOOP_UNTIL = "until" //每次执行后判断循环条件，满足时结束循环
 )
 
 type ActionContent struct {
@@ -19,28 +40,40 @@ type ActionContent struct {
 	Content     string `bson:"content" json:"content"`           //内容文本
 }
 type ActionModel struct {
-	Id              string            `bson:"id" json:"id"`                       //ID
-	Name            string            `bson:"name" json:"name"`                   //名称
-	Title           string            `bson:"title" json:"title"`                 //标题
-	Icon            string            `bson:"icon" json:"icon"`                   //图标
-	Des             string            `bson:"des" json:"des"`                     //描述
-	Keywords        string            `bson:"keywords" json:"keywords"`           //关键词
-	Left            string            `bson:"left" json:"left"`                   //位置X
-	Top             string            `bson:"top" json:"top"`                     //位置Y
-	Width           string            `bson:"width" json:"width"`                 //宽度
-	Height          string            `bson:"height" json:"height"`               //高度
-	Theme           string            `bson:"theme" json:"theme"`                 //样式
-	BodyWidth       string            `bson:"body_width" json:"body_width"`       //内容宽度
-	BodyHeight      string            `bson:"body_height" json:"body_height"`     //内容高度
-	Params          map[string]string `bson:"params" json:"params"`               //运行配置参数
-	Collect         string            `bson:"collect" json:"collect"`             //true：所有路线到达节点后才执行；false：任意一个路径到达都执行
-	Once            string            `bson:"once" json:"once"`                   //是否在整个过程只执行一次： true，false
-	IteratorList    string            `bson:"iterator_list" json:"iterator_list"` //迭代列表参数名，根据列表轮询执行
-	IteratorItem    string            `bson:"iterator_item" json:"iterator_item"` //迭代元素参数名
-	ScriptBefore    string            `bson:"script_before" json:"script_before"` //执行过滤脚本
-	ScriptAfter     string            `bson:"script_after" json:"script_after"`   //执行内容脚本
-	ScriptError     string            `bson:"script_error" json:"script_error"`   //执行异常处理脚本
-	Content         *ActionContent    `bson:"content" json:"content"`             //显示内容
+	Id              string            `bson:"id" json:"id"`                           //ID
+	Name            string            `bson:"name" json:"name"`                       //名称
+	Title           string            `bson:"title" json:"title"`                     //标题
+	Icon            string            `bson:"icon" json:"icon"`                       //图标
+	Des             string            `bson:"des" json:"des"`                         //描述
+	Keywords        string            `bson:"keywords" json:"keywords"`               //关键词
+	Left            string            `bson:"left" json:"left"`                       //位置X
+	Top             string            `bson:"top" json:"top"`                         //位置Y
+	Width           string            `bson:"width" json:"width"`                     //宽度
+	Height          string            `bson:"height" json:"height"`                   //高度
+	Theme           string            `bson:"theme" json:"theme"`                     //样式
+	BodyWidth       string            `bson:"body_width" json:"body_width"`           //内容宽度
+	BodyHeight      string            `bson:"body_height" json:"body_height"`         //内容高度
+	Params          map[string]string `bson:"params" json:"params"`                   //运行配置参数
+	Collect         string            `bson:"collect" json:"collect"`                 //true：所有路线到达节点后才执行；false：任意一个路径到达都执行
+	CollectMode     string            `bson:"collect_mode" json:"collect_mode"`       //汇聚方式：all，any，count，first，timeout；为空时根据collect判断
+	CollectCount    int               `bson:"collect_count" json:"collect_count"`     //count方式需要通过的连入路径数量
+	CollectTimeout  string            `bson:"collect_timeout" json:"collect_timeout"` //timeout方式等待的时长，毫秒数或者时长格式，从第一个路径到达开始计算
+	CollectCancel   string            `bson:"collect_cancel" json:"collect_cancel"`   //汇聚节点执行后是否取消还在执行的连入路径源节点：true，false
+	Once            string            `bson:"once" json:"once"`                       //是否在整个过程只执行一次： true，false
+	Gateway         string            `bson:"gateway" json:"gateway"`                 //执行后的路由方式：parallel，exclusive
+	Timeout         string            `bson:"timeout" json:"timeout"`                 //执行时效，毫秒数或者时长格式，例如"5s"
+	Retry           *RetryModel       `bson:"retry" json:"retry"`                     //失败重试策略
+	Loop            string            `bson:"loop" json:"loop"`                       //循环方式：while，until；为空时不循环
+	LoopCondition   string            `bson:"loop_condition" json:"loop_condition"`   //循环条件脚本，返回true或者false
+	MaxVisits       int               `bson:"max_visits" json:"max_visits"`           //整个过程最多执行的次数，超过时流程失败，0表示不限制
+	IteratorList    string            `bson:"iterator_list" json:"iterator_list"`     //迭代列表参数名，根据列表轮询执行
+	IteratorItem    string            `bson:"iterator_item" json:"iterator_item"`     //迭代元素参数名
+	ScriptBefore    string            `bson:"script_before" json:"script_before"`     //执行过滤脚本
+	ScriptAfter     string            `bson:"script_after" json:"script_after"`       //执行内容脚本
+	ScriptError     string            `bson:"script_error" json:"script_error"`       //执行异常处理脚本
+	Compensate      string            `bson:"compensate" json:"compensate"`           //补偿脚本，流程失败、超时或者取消时撤销已经完成的节点
+	Compensator     string            `bson:"compensator" json:"compensator"`         //补偿执行器名称，设置后代替补偿脚本
+	Content         *ActionContent    `bson:"content" json:"content"`                 //显示内容
 	BorderColor     string            `bson:"border_color" json:"border_color"`
 	BodyColor       string            `bson:"body_color" json:"body_color"`
 	BodyTextColor   string            `bson:"body_text_color" json:"body_text_color"`
@@ -48,6 +81,44 @@ type ActionModel struct {
 	HeaderTextColor string            `bson:"header_text_color" json:"header_text_color"`
 }
 
+// 是否设置了补偿
+func (m *ActionModel) HasCompensate() bool {
+	return len(m.Compensator) > 0 || len(strings.TrimSpace(m.Compensate)) > 0
+}
+
+// 是否为循环节点
+func (m *ActionModel) IsLoop() bool {
+	return isLoop(m.Loop, m.LoopCondition)
+}
+
+// 是否为排他路由
+func (m *ActionModel) IsExclusive() bool {
+	return strings.ToLower(m.Gateway) == GATEWAY_EXCLUSIVE
+}
+
+// 获取汇聚方式
+func (m *ActionModel) GetCollectMode() string {
+	if len(m.CollectMode) > 0 {
+		return strings.ToLower(m.CollectMode)
+	}
+	if strings.ToLower(m.Collect) == "true" {
+		return COLLECT_MODE_ALL
+	}
+	return COLLECT_MODE_ANY
+}
+
+// 获取汇聚等待时长（毫秒）
+func (m *ActionModel) GetCollectTimeout() int64 {
+	if len(strings.TrimSpace(m.CollectTimeout)) == 0 {
+		return 0
+	}
+	d, err := ParseDuration(m.CollectTimeout)
+	if err != nil {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
 func (m *ActionModel) GetParam(name string) string {
 	if m.Params != nil {
 		return m.Params[name]
@@ -61,6 +132,20 @@ func (m *ActionModel) SetParam(name string, value string) {
 
 	m.Params[name] = value
 }
+
+// 获取节点执行时效（毫秒），优先使用Timeout，其次使用运行配置参数timeout，没有设置返回0
+func (m *ActionModel) GetTimeout() int64 {
+	str := m.Timeout
+	if len(strings.TrimSpace(str)) == 0 {
+		str = m.GetParam("timeout")
+	}
+	d, err := ParseDuration(str)
+	if err != nil {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
 func (m *ActionModel) SetContent(content_type string, content string) {
 
 	m.Content = &ActionContent{ContentType: content_type, Content: content}
@@ -84,12 +169,20 @@ type LinkModel struct {
 	TargetPosition string `bson:"target_position" json:"target_position"` //目的位置
 	Filter         string `bson:"filter" json:"filter"`                   //过滤脚本
 	Active         string `bson:"active" json:"active"`                   //是否是一个可通的路径，true,false
+	Order          int    `bson:"order" json:"order"`                     //排他路由时的判断顺序，从小到大
+	Default        string `bson:"default" json:"default"`                 //排他路由时是否为默认路径，其他路径都不满足时执行：true，false
+	On             string `bson:"on" json:"on"`                           //触发条件：success，error
 	LabelSource    string `bson:"label_source" json:"label_source"`       //头标签
 	LabelTarget    string `bson:"label_target" json:"label_target"`       //尾标签
 	Animation      bool   `bson:"animation" json:"animation"`             //是否动画
 	Arrows         []bool `bson:"arrows" json:"arrows"`                   //是否显示头中间和尾箭头
 }
 
+// 是否为源节点失败时执行的错误路径
+func (m *LinkModel) IsErrorLink() bool {
+	return strings.ToLower(m.On) == LINK_ON_ERROR
+}
+
 type GroupModel struct {
 	Id      string   `bson:"id" json:"id"`           //组ID
 	Title   string   `bson:"title" json:"title"`     //标题
@@ -101,6 +194,13 @@ type GroupModel struct {
 	Width   string   `bson:"width" json:"width"`     //宽度
 	Height  string   `bson:"height" json:"height"`   //高度
 
+	Timeout      string `bson:"timeout" json:"timeout"`             //组执行时效，毫秒数或者时长格式
+	IteratorList string `bson:"iterator_list" json:"iterator_list"` //迭代列表参数名，按照列表每个元素执行一次组
+	IteratorItem string `bson:"iterator_item" json:"iterator_item"` //迭代元素参数名
+
+	Loop          string `bson:"loop" json:"loop"`                     //循环方式：while，until；为空时不循环
+	LoopCondition string `bson:"loop_condition" json:"loop_condition"` //循环条件脚本，返回true或者false
+
 	BorderColor string `bson:"border_color" json:"border_color"`
 
 	BodyColor     string `bson:"body_color" json:"body_color"`
@@ -110,6 +210,30 @@ type GroupModel struct {
 	HeaderTextColor string `bson:"header_text_color" json:"header_text_color"`
 }
 
+// 获取组执行时效（毫秒），没有设置返回0
+func (g *GroupModel) GetTimeout() int64 {
+	d, err := ParseDuration(g.Timeout)
+	if err != nil {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
+// 是否循环执行
+func (g *GroupModel) IsLoop() bool {
+	return isLoop(g.Loop, g.LoopCondition)
+}
+
+// 是否迭代或者循环执行
+func (g *GroupModel) IsIterate() bool {
+	return len(g.IteratorList) > 0 || g.IsLoop()
+}
+
+// 是否为组成员
+func (g *GroupModel) HasMember(actionId string) bool {
+	return arrayIndexOf(g.Members, actionId) >= 0
+}
+
 type ListModel struct {
 	Id     string   `bson:"id" json:"id"`         //组ID
 	Title  string   `bson:"title" json:"title"`   //标题
@@ -163,8 +287,9 @@ type FlowDictModel struct {
 type FlowModel struct {
 	Code                string            `bson:"code" json:"code"`
 	Name                string            `bson:"name" json:"name"`                                     //流程名称
+	Version             string            `bson:"version" json:"version"`                               //版本，流程仓库中相同编码的流程按照版本区分
 	FlowType            string            `bson:"flow_type" json:"flow_type"`                           //流程类型
-	Timeout             string            `bson:"timeout" json:"timeout"`                               //执行时效
+	Timeout             string            `bson:"timeout" json:"timeout"`                               //执行时效，毫秒数或者时长格式。格式错误时执行时记录错误日志，不限制执行时效
 	CacheTimeout        string            `bson:"cache_timeout" json:"cache_timeout"`                   //缓存时效
 	Params              []*FlowParamModel `bson:"params" json:"params"`                                 //运行参数列表
 	Dict                []*FlowDictModel  `bson:"dict" json:"dict"`                                     //运行字典列表
@@ -184,6 +309,15 @@ type FlowModel struct {
 
 }
 
+// 获取流程执行时效（毫秒），没有设置或者格式错误返回0
+func (t *FlowModel) GetTimeout() int64 {
+	d, err := ParseDuration(t.Timeout)
+	if err != nil {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
 func (t *FlowModel) GetDict(name string) *FlowDictModel {
 	if t.Dict == nil || len(t.Dict) == 0 {
 		return nil
@@ -274,6 +408,31 @@ func (t *FlowModel) GetActionIdsInGroup(groupId string) []string {
 
 }
 
+// 获取节点所在的组，不在组内返回nil
+func (t *FlowModel) GetGroupByActionId(actionId string) *GroupModel {
+	for _, g := range t.Groups {
+		if g.HasMember(actionId) {
+			return g
+		}
+	}
+	return nil
+}
+
+// 获取离开组的可通路径，源节点在组内，目的节点在组外
+func (t *FlowModel) GetExitLinksOfGroup(groupId string) []*LinkModel {
+	lks := make([]*LinkModel, 0)
+	g := t.GetGroup(groupId)
+	if g == nil {
+		return lks
+	}
+	for _, link := range t.Links {
+		if link.Active != "false" && g.HasMember(link.SourceId) && !g.HasMember(link.TargetId) {
+			lks = append(lks, link)
+		}
+	}
+	return lks
+}
+
 // 获取作为起点的节点
 func (t *FlowModel) GetStartActionIds() []string {
 
@@ -289,7 +448,7 @@ func (t *FlowModel) GetStartActionIds() []string {
 	return actions_start
 }
 
-// 获取组内的起点节点
+// 获取组内的起点节点，没有来自组内其他节点的连入路径
 func (t *FlowModel) GetStartActionIdsInGroup(groupId string) []string {
 
 	actions_start := make([]string, 0)
@@ -300,9 +459,17 @@ func (t *FlowModel) GetStartActionIdsInGroup(groupId string) []string {
 	}
 
 	for _, memberId := range g.Members {
+		if t.GetAction(memberId) == nil {
+			continue
+		}
 
-		links := t.GetLinkByTargetId(memberId)
-		if links == nil || len(links) == 0 {
+		inner := false
+		for _, link := range t.GetLinkByTargetId(memberId) {
+			if g.HasMember(link.SourceId) {
+				inner = true
+			}
+		}
+		if !inner {
 			actions_start = append(actions_start, memberId)
 		}
 	}
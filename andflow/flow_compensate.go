@@ -0,0 +1,115 @@
+package andflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// 补偿，按照完成顺序倒序执行已经完成节点的补偿，每次完成只补偿一次。
+// 会话上下文已经结束，补偿使用独立的上下文，只受节点执行时效限制
+func (s *Session) compensate() {
+	flow := s.GetFlow()
+	states := s.Operation.Snapshot().ActionStates
+
+	//已经补偿过的次数，恢复执行后再次失败时不重复补偿
+	compensated := make(map[string]int)
+	for _, st := range states {
+		if st.IsCompensate == 1 {
+			compensated[st.ActionId]++
+		}
+	}
+
+	completed := make([]*ActionStateModel, 0)
+	for _, st := range states {
+		if st.IsCompensate == 1 || st.IsSkip == 1 || st.State != int(RESULT_SUCCESS) {
+			continue
+		}
+		action := flow.GetAction(st.ActionId)
+		if action == nil || !action.HasCompensate() {
+			continue
+		}
+		if compensated[st.ActionId] > 0 {
+			compensated[st.ActionId]--
+			continue
+		}
+		completed = append(completed, st)
+	}
+
+	for i := len(completed) - 1; i >= 0; i-- {
+		st := completed[i]
+		s.compensateAction(&ActionParam{RuntimeId: s.Id, ActionId: st.ActionId, PreActionId: st.PreActionId, IsCompensate: 1})
+	}
+}
+
+// 执行节点补偿，结果记录为补偿状态
+func (s *Session) compensateAction(param *ActionParam) {
+	action := s.GetFlow().GetAction(param.ActionId)
+	state := s.createActionState(param.ActionId, param.PreActionId)
+	state.IsCompensate = 1
+
+	parent := context.WithValue(context.Background(), contextKeyRuntimeId, s.Id)
+	ctx, cancel := s.createActionContextFrom(parent, param, action.GetTimeout())
+	defer cancel()
+
+	s.AddLog_action_info(action.Name, action.Title, "开始补偿")
+
+	res, err := s.executeCompensate(ctx, action, param, state)
+	if err == nil && res == RESULT_FAILURE {
+		err = errors.New("补偿返回错误")
+	}
+	if err != nil {
+		res = RESULT_FAILURE
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ErrActionTimeout
+			state.IsTimeout = 1
+		}
+		state.IsError = 1
+		state.Error = err.Error()
+		s.AddLog_action_error(action.Name, action.Title, fmt.Sprintf("补偿失败：%v", err))
+	} else {
+		s.AddLog_action_info(action.Name, action.Title, "补偿完成")
+	}
+
+	state.State = int(res)
+	state.EndTime = time.Now()
+	state.Timeused = state.EndTime.Sub(state.BeginTime).Milliseconds()
+	s.Operation.AddActionState(state)
+}
+
+// 执行补偿执行器或者补偿脚本
+func (s *Session) executeCompensate(ctx context.Context, action *ActionModel, param *ActionParam, state *ActionStateModel) (res Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = RESULT_FAILURE
+			err = fmt.Errorf("补偿异常：%v", r)
+		}
+	}()
+
+	if len(action.Compensator) > 0 {
+		runner, ok := GetActionRunners()[action.Compensator]
+		if !ok || runner == nil {
+			return RESULT_FAILURE, fmt.Errorf("补偿执行器不存在：%s", action.Compensator)
+		}
+		return ToContextActionRunner(runner).ExecuteContext(ctx, s, param, state)
+	}
+
+	rts := goja.New()
+	rts.Set("flow", s.GetFlow())
+	rts.Set("action", action)
+	SetCommonActionScriptFunc(rts, s, param, state)
+
+	stopInterrupt := InterruptScriptOnDone(ctx, rts)
+	defer stopInterrupt()
+
+	script := "function $exec(){\n" + strings.TrimSpace(action.Compensate) + "\n}\n $exec();\n"
+	val, err := rts.RunString(script)
+	if err != nil {
+		return RESULT_FAILURE, err
+	}
+	return GetScriptIntResult(val), nil
+}
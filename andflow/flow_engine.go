@@ -9,7 +9,7 @@ import (
 	"github.com/gofrs/uuid"
 )
 
-var runnings map[string]*Session = make(map[string]*Session)
+var runnings = NewSessionRegistry()
 
 func ParseFlow(content string) (*FlowModel, error) {
 
@@ -28,6 +28,8 @@ func CreateRuntime(flow *FlowModel, param map[string]interface{}) *RuntimeModel
 	id := strings.ReplaceAll(uid.String(), "-", "")
 	runtime.Id = id
 	runtime.Flow = flow
+	runtime.FlowCode = flow.Code
+	runtime.FlowVersion = flow.Version
 	runtime.FlowState = 0
 	runtime.Des = flow.Name
 	//初始化状态
@@ -62,37 +64,82 @@ func CreateRuntime(flow *FlowModel, param map[string]interface{}) *RuntimeModel
 	return &runtime
 }
 
+// 获取正在执行的会话，返回的是副本
 func GetSessions() map[string]*Session {
-	return runnings
+	return runnings.GetAll()
 }
 func GetSession(runtimeId string) *Session {
-	return runnings[runtimeId]
+	return runnings.Get(runtimeId)
 }
 
+// 按照流程编码、用户ID、组查询正在执行的会话
+func ListSessions(filter SessionFilter) []*Session {
+	return runnings.List(filter)
+}
+
+// 取消正在执行的会话，原因记录在运行时的信息中
+func CancelSession(runtimeId string, reason string) error {
+	return runnings.Cancel(runtimeId, reason)
+}
+
+// 等待会话执行结束
+func WaitSession(ctx context.Context, runtimeId string) error {
+	return runnings.Wait(ctx, runtimeId)
+}
+
+// 执行流程，timeout为执行时效（毫秒），为0时使用流程定义的执行时效
 func Execute(operation RuntimeOperation, router FlowRouter, runner FlowRunner, timeout int64) {
+	ExecuteContext(context.Background(), operation, router, runner, timeout)
+}
 
-	ctx := context.Background()
-	if timeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, time.Millisecond*time.Duration(timeout))
-	}
+// 在指定的上下文中执行流程，上下文取消或者超时的时候流程结束
+func ExecuteContext(ctx context.Context, operation RuntimeOperation, router FlowRouter, runner FlowRunner, timeout int64) {
 
 	session := CreateSession(ctx, operation, router, runner)
 
-	runnings[session.Id] = session
-	defer delete(runnings, session.Id)
+	ExecuteSession(session, timeout)
+
+}
+
+// 执行会话，可以在执行前设置会话的工作协程数量等配置。timeout为执行时效（毫秒），为0时使用流程定义的执行时效
+func ExecuteSession(session *Session, timeout int64) {
+
+	if timeout <= 0 {
+		flow := session.GetFlow()
+		if _, err := ParseDuration(flow.Timeout); err != nil {
+			session.AddLog_flow_error(flow.Code, flow.Name, "流程执行时效格式错误，不限制执行时效："+flow.Timeout)
+		}
+		timeout = flow.GetTimeout()
+	}
+	//记录实际使用的执行时效
+	session.Operation.SetTimeout(timeout)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		session.Ctx, cancel = context.WithTimeout(session.Ctx, time.Millisecond*time.Duration(timeout))
+		defer cancel()
+	}
+
+	runnings.Add(session)
+	defer runnings.Remove(session.Id)
 
 	session.Execute()
 
 }
 
 func ExecuteRuntime(runtime *RuntimeModel, timeout int64) *RuntimeModel {
+	return ExecuteRuntimeContext(context.Background(), runtime, timeout)
+}
+
+// 在指定的上下文中执行运行时，子流程使用父流程的上下文，父流程取消或者超时的时候一起结束
+func ExecuteRuntimeContext(ctx context.Context, runtime *RuntimeModel, timeout int64) *RuntimeModel {
 	runner := &CommonFlowRunner{}
 	router := &CommonFlowRouter{}
 	operation := &CommonRuntimeOperation{}
 	operation.Init(runtime)
 	// operation.SetRuntime(runtime)
 
-	Execute(operation, router, runner, timeout)
+	ExecuteContext(ctx, operation, router, runner, timeout)
 	runtime = operation.GetRuntime()
 
 	return runtime
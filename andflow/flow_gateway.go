@@ -0,0 +1,71 @@
+package andflow
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrNoRoute = errors.New("排他路由没有满足条件的路径")
+
+// 排他路由，按照顺序判断连接线的过滤条件，选择第一个满足条件的路径，都不满足时选择默认路径。
+// 判断过程记录在节点状态的Routes中
+func (s *Session) routeExclusive(param *ActionParam, actionState *ActionStateModel) (*LinkModel, error) {
+	flow := s.GetFlow()
+	nextActionIds := actionState.NextActionIds
+
+	links := make([]*LinkModel, 0)
+	var defaultLink *LinkModel
+	for _, link := range flow.GetLinkBySourceId(param.ActionId) {
+		if link.Active == "false" || link.IsErrorLink() {
+			continue
+		}
+		if len(nextActionIds) > 0 && arrayIndexOf(nextActionIds, link.TargetId) < 0 {
+			continue
+		}
+		if strings.ToLower(link.Default) == "true" {
+			if defaultLink == nil {
+				defaultLink = link
+			}
+			continue
+		}
+		links = append(links, link)
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Order < links[j].Order
+	})
+
+	routes := make([]*ActionRouteModel, 0)
+	defer func() {
+		actionState.Routes = routes
+	}()
+
+	for _, link := range links {
+		route := &ActionRouteModel{TargetId: link.TargetId, Order: link.Order}
+		routes = append(routes, route)
+
+		linkParam := s.createLinkParam(param, link)
+		res, err := executeFlowRunnerLink(s.GetActionContext(param), s.Runner, s, linkParam, s.createLinkState(link.SourceId, link.TargetId))
+		if err != nil {
+			res = RESULT_FAILURE
+			route.Error = err.Error()
+		}
+		route.State = int(res)
+
+		if res == RESULT_SUCCESS {
+			route.IsChosen = 1
+			return link, nil
+		}
+	}
+
+	if defaultLink != nil {
+		routes = append(routes, &ActionRouteModel{TargetId: defaultLink.TargetId, Order: defaultLink.Order, IsDefault: 1, State: int(RESULT_SUCCESS), IsChosen: 1})
+		return defaultLink, nil
+	}
+
+	//没有后续路径的节点不需要选择
+	if len(links) == 0 {
+		return nil, nil
+	}
+	return nil, ErrNoRoute
+}
@@ -0,0 +1,362 @@
+package andflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrGroupTimeout = errors.New("组执行超时")
+
+// 正在执行的组。组作为一个整体执行：从起点节点进入，组内的节点和连接线都完成后组结束，
+// 然后按照结果执行离开组的路径
+type groupScope struct {
+	group       *GroupModel
+	preActionId string         //进入组的上一个节点ID
+	pending     int            //组内还没有完成的节点和连接线数量
+	iteration   int            //当前迭代或者循环次数，从1开始，不迭代时为0
+	items       []interface{}  //迭代列表
+	failures    int            //组内没有处理的失败节点数量
+	err         string         //第一个失败节点的错误信息
+	exits       []*LinkParam   //组内到达的离开组的路径
+	passAll     bool           //没有需要执行的内容，离开组的路径都通过
+	waiting     int            //组内拒绝执行、等待下次执行的节点数量
+	entries     []*ActionParam //组执行期间再次到达的进入组的节点，组结束后重新进入
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// 创建组的执行范围，需要持有groupLock
+func (s *Session) createGroupScope(group *GroupModel, preActionId string, iteration int) *groupScope {
+	scope := &groupScope{group: group, preActionId: preActionId, iteration: iteration}
+	timeout := group.GetTimeout()
+	if timeout > 0 {
+		scope.ctx, scope.cancel = context.WithTimeout(s.Ctx, time.Millisecond*time.Duration(timeout))
+	} else {
+		scope.ctx, scope.cancel = context.WithCancel(s.Ctx)
+	}
+	if len(group.IteratorList) > 0 {
+		scope.items = s.getIteratorList(group.IteratorList)
+	}
+	s.groups[group.Id] = scope
+	return scope
+}
+
+// 到达组内的节点时进入组，返回true表示已经由组处理。进入组的路径都到达后才进入，
+// 组正在执行时保留在待执行列表中，组结束后再次进入
+func (s *Session) enterGroup(param *ActionParam) bool {
+	group := s.GetFlow().GetGroupByActionId(param.ActionId)
+	if group == nil || param.GroupId == group.Id {
+		return false
+	}
+
+	s.groupLock.Lock()
+	if scope, ok := s.groups[group.Id]; ok {
+		scope.entries = append(scope.entries, param)
+		s.groupLock.Unlock()
+		s.Operation.AddRunningAction(param)
+		s.AddLog_group_info(group.Id, group.Title, fmt.Sprintf("组正在执行，从%s进入的路径等待组结束", param.PreActionId))
+		return true
+	}
+	//恢复执行时从待执行列表中进入组
+	s.Operation.DelRunningAction(param)
+	//死路径，组内不执行，离开组的路径继续传递跳过标记
+	if param.IsSkip == 1 {
+		s.groupLock.Unlock()
+		s.AddLog_group_info(group.Id, group.Title, "死路径，跳过")
+		s.skipGroupExits(group)
+		return true
+	}
+	scope := s.createGroupScope(group, param.PreActionId, 0)
+	s.groupLock.Unlock()
+
+	s.AddLog_group_info(group.Id, group.Title, "进入组")
+	s.startGroup(scope)
+	return true
+}
+
+// 开始组的下一次执行，迭代执行时设置迭代元素，while循环时先判断循环条件。没有可以执行的内容时直接结束
+func (s *Session) startGroup(scope *groupScope) {
+	group := scope.group
+	startIds := s.GetFlow().GetStartActionIdsInGroup(group.Id)
+
+	if group.IsIterate() {
+		if len(group.IteratorList) > 0 && scope.iteration >= len(scope.items) {
+			scope.passAll = scope.iteration == 0
+			s.finishGroup(scope)
+			return
+		}
+		if strings.ToLower(group.Loop) == LOOP_WHILE {
+			ok, err := s.checkGroupLoop(scope, scope.iteration+1)
+			if err != nil {
+				s.failGroupLoop(scope, err)
+			}
+			if err != nil || !ok {
+				scope.passAll = err == nil && scope.iteration == 0
+				s.finishGroup(scope)
+				return
+			}
+		}
+		//离开组的路径只按照最后一次迭代的结果执行
+		s.groupLock.Lock()
+		scope.iteration++
+		scope.exits = nil
+		s.groupLock.Unlock()
+		if len(group.IteratorList) > 0 && len(group.IteratorItem) > 0 {
+			s.SetParam(group.IteratorItem, scope.items[scope.iteration-1])
+		}
+		s.AddLog_group_info(group.Id, group.Title, fmt.Sprintf("第%d次迭代", scope.iteration))
+	}
+	if len(startIds) == 0 {
+		scope.passAll = true
+		s.finishGroup(scope)
+		return
+	}
+
+	//起点节点都提交后才允许组结束
+	s.addGroupPending(group.Id, scope.iteration)
+	for _, actionId := range startIds {
+		s.ToAction(&ActionParam{RuntimeId: s.Id, ActionId: actionId, PreActionId: scope.preActionId, GroupId: group.Id, Iteration: scope.iteration})
+	}
+	s.leaveGroup(group.Id)
+}
+
+// 组内的节点或者连接线准备执行。恢复执行时组的执行范围不存在，按照参数重新创建
+func (s *Session) addGroupPending(groupId string, iteration int) {
+	if len(groupId) == 0 {
+		return
+	}
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+
+	scope, ok := s.groups[groupId]
+	if !ok {
+		group := s.GetFlow().GetGroup(groupId)
+		if group == nil {
+			return
+		}
+		scope = s.createGroupScope(group, "", iteration)
+	}
+	scope.pending++
+}
+
+// 暂停后恢复执行，重新提交的节点和连接线已经计入组内的数量
+func (s *Session) resumeGroupPending(groupId string) {
+	s.leaveGroup(groupId)
+}
+
+// 组内的节点拒绝执行，保留在待执行列表中，本次执行组不结束
+func (s *Session) waitGroup(groupId string) {
+	if len(groupId) == 0 {
+		return
+	}
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+	if scope, ok := s.groups[groupId]; ok {
+		scope.waiting++
+	}
+}
+
+// 组内的节点或者连接线执行完成，组内都完成后进入下一次迭代或者结束
+func (s *Session) leaveGroup(groupId string) {
+	if len(groupId) == 0 {
+		return
+	}
+	s.groupLock.Lock()
+	scope, ok := s.groups[groupId]
+	if !ok {
+		s.groupLock.Unlock()
+		return
+	}
+	scope.pending--
+	if scope.pending > 0 {
+		s.groupLock.Unlock()
+		return
+	}
+	//停止或者有等待下次执行的节点时保留组的执行范围
+	if s.Operation.GetCmd() == CMD_STOP || scope.waiting > 0 {
+		s.groupLock.Unlock()
+		return
+	}
+	//失败后不再继续迭代
+	next := scope.failures == 0 && scope.group.IsIterate()
+	s.groupLock.Unlock()
+
+	if next && s.nextGroupLoop(scope) {
+		s.startGroup(scope)
+		return
+	}
+	s.finishGroup(scope)
+}
+
+// 组的一次执行完成后判断是否继续，until循环满足条件时结束
+func (s *Session) nextGroupLoop(scope *groupScope) bool {
+	group := scope.group
+	if len(group.IteratorList) > 0 && scope.iteration >= len(scope.items) {
+		return false
+	}
+	if strings.ToLower(group.Loop) != LOOP_UNTIL {
+		return true
+	}
+	done, err := s.checkGroupLoop(scope, scope.iteration)
+	if err != nil {
+		s.failGroupLoop(scope, err)
+		return false
+	}
+	return !done
+}
+
+// 组结束，成功时执行组内到达的离开组的路径，失败时执行离开组的错误路径，其他路径为死路径
+func (s *Session) finishGroup(scope *groupScope) {
+	group := scope.group
+
+	s.groupLock.Lock()
+	delete(s.groups, group.Id)
+	exits := scope.exits
+	failed := scope.failures > 0
+	entries := scope.entries
+	s.groupLock.Unlock()
+
+	timeout := scope.ctx.Err() == context.DeadlineExceeded
+	scope.cancel()
+	if failed && timeout {
+		scope.err = ErrGroupTimeout.Error()
+	}
+
+	if failed {
+		s.AddLog_group_error(group.Id, group.Title, "组执行失败："+scope.err)
+	} else {
+		s.AddLog_group_info(group.Id, group.Title, "组执行完成")
+	}
+
+	passed := make(map[string]*LinkParam)
+	for _, p := range exits {
+		if p.IsSkip == 0 {
+			passed[p.SourceId+"_"+p.TargetId] = p
+		}
+	}
+
+	for _, link := range s.GetFlow().GetExitLinksOfGroup(group.Id) {
+		param := &ActionParam{RuntimeId: s.Id, ActionId: link.SourceId}
+		linkParam := s.createLinkParam(param, link)
+
+		if failed {
+			if !link.IsErrorLink() {
+				s.skipLink(param, link)
+				continue
+			}
+			linkParam.Error = &ActionErrorModel{ActionId: group.Id, Runner: "group", Message: scope.err, Attempt: scope.iteration}
+			if timeout {
+				linkParam.Error.IsTimeout = 1
+			}
+			s.ToLink(linkParam)
+			continue
+		}
+
+		if scope.passAll && !link.IsErrorLink() {
+			s.ToLink(linkParam)
+			continue
+		}
+		p, ok := passed[link.SourceId+"_"+link.TargetId]
+		if !ok {
+			s.skipLink(param, link)
+			continue
+		}
+		linkParam.IsChosen = p.IsChosen
+		linkParam.Error = p.Error
+		s.ToLink(linkParam)
+	}
+
+	//组执行期间再次到达的进入组的节点，按照到达顺序重新进入
+	for _, param := range entries {
+		s.ToAction(param)
+	}
+}
+
+// 组内的节点失败，记录到组。组有离开组的错误路径时返回true，表示错误由组处理
+func (s *Session) failGroup(param *ActionParam, actionState *ActionStateModel) bool {
+	if len(param.GroupId) == 0 {
+		return false
+	}
+
+	s.groupLock.Lock()
+	scope, ok := s.groups[param.GroupId]
+	if ok {
+		if scope.failures == 0 {
+			scope.err = actionState.Error
+		}
+		scope.failures++
+	}
+	s.groupLock.Unlock()
+
+	return s.hasGroupErrorExit(param.GroupId)
+}
+
+// 组是否有离开组的错误路径
+func (s *Session) hasGroupErrorExit(groupId string) bool {
+	for _, link := range s.GetFlow().GetExitLinksOfGroup(groupId) {
+		if link.IsErrorLink() {
+			return true
+		}
+	}
+	return false
+}
+
+// 组内节点到达离开组的路径时先记录，返回true表示已经由组处理
+func (s *Session) exitGroup(param *LinkParam) bool {
+	if len(param.GroupId) == 0 {
+		return false
+	}
+	group := s.GetFlow().GetGroup(param.GroupId)
+	if group == nil || group.HasMember(param.TargetId) {
+		return false
+	}
+
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+	if scope, ok := s.groups[param.GroupId]; ok {
+		scope.exits = append(scope.exits, param)
+	}
+	return true
+}
+
+// 组为死路径时，离开组的路径都传递跳过标记
+func (s *Session) skipGroupExits(group *GroupModel) {
+	for _, link := range s.GetFlow().GetExitLinksOfGroup(group.Id) {
+		s.skipLink(&ActionParam{RuntimeId: s.Id, ActionId: link.SourceId}, link)
+	}
+}
+
+// 获取组的执行上下文，不在组内返回nil
+func (s *Session) getGroupContext(groupId string) context.Context {
+	if len(groupId) == 0 {
+		return nil
+	}
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+	if scope, ok := s.groups[groupId]; ok {
+		return scope.ctx
+	}
+	return nil
+}
+
+// 根据参数名获取迭代列表，参数可以是列表或者json数组字符串
+func (s *Session) getIteratorList(name string) []interface{} {
+	list := make([]interface{}, 0)
+	switch val := s.GetParam(name).(type) {
+	case []interface{}:
+		list = append(list, val...)
+	case []string:
+		for _, item := range val {
+			list = append(list, item)
+		}
+	case string:
+		if err := json.Unmarshal([]byte(val), &list); err != nil {
+			list = append(list, val)
+		}
+	}
+	return list
+}
@@ -0,0 +1,335 @@
+package andflow
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 汇聚节点的等待状态
+type joinState struct {
+	fired   bool                       //已经执行或者确定为死路径
+	waiting bool                       //已经开始等待超时
+	done    chan struct{}              //执行后关闭，结束超时等待
+	since   map[string]*LinkStateModel //上次执行时已经使用的连入路径状态，在环路中再次到达时忽略
+}
+
+// 汇聚节点的索引，流程执行期间不变，每个会话计算一次。组按照汇聚节点处理，等待所有进入组的路径
+type collectIndex struct {
+	collect   map[string]bool         //汇聚节点
+	reach     map[string]bool         //节点本身或者沿可通的路径往下有汇聚节点
+	joinLinks map[string][]*LinkModel //汇聚时需要等待的连入路径，组ID对应进入组的路径
+}
+
+// 计算汇聚节点的索引，遍历一次连线得到连入路径，再从汇聚节点和有多个进入路径的组沿连线反向查找可以到达的节点
+func createCollectIndex(flow *FlowModel) *collectIndex {
+	index := &collectIndex{collect: make(map[string]bool), reach: make(map[string]bool), joinLinks: make(map[string][]*LinkModel)}
+
+	groups := make(map[string]*GroupModel)
+	for i := len(flow.Groups) - 1; i >= 0; i-- {
+		for _, id := range flow.Groups[i].Members {
+			groups[id] = flow.Groups[i]
+		}
+	}
+
+	sources := make(map[string][]string)
+	for _, link := range flow.Links {
+		if link.Active == "false" {
+			continue
+		}
+		sources[link.TargetId] = append(sources[link.TargetId], link.SourceId)
+		//组内的节点只等待来自组内的路径，来自组外的路径为进入组的路径
+		if g, ok := groups[link.TargetId]; ok && !g.HasMember(link.SourceId) {
+			index.joinLinks[g.Id] = append(index.joinLinks[g.Id], link)
+			continue
+		}
+		index.joinLinks[link.TargetId] = append(index.joinLinks[link.TargetId], link)
+	}
+
+	queue := make([]string, 0)
+	for _, action := range flow.Actions {
+		if action.GetCollectMode() != COLLECT_MODE_ANY && len(index.joinLinks[action.Id]) > 1 {
+			index.collect[action.Id] = true
+			index.reach[action.Id] = true
+			queue = append(queue, action.Id)
+		}
+	}
+	for _, group := range flow.Groups {
+		if len(index.joinLinks[group.Id]) <= 1 {
+			continue
+		}
+		for _, link := range index.joinLinks[group.Id] {
+			if !index.reach[link.TargetId] {
+				index.reach[link.TargetId] = true
+				queue = append(queue, link.TargetId)
+			}
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, sourceId := range sources[id] {
+			if !index.reach[sourceId] {
+				index.reach[sourceId] = true
+				queue = append(queue, sourceId)
+			}
+		}
+	}
+	return index
+}
+
+func (s *Session) getCollectIndex() *collectIndex {
+	s.collectOnce.Do(func() {
+		s.collects = createCollectIndex(s.GetFlow())
+	})
+	return s.collects
+}
+
+// 是否为汇聚节点
+func (s *Session) isCollectAction(actionId string) bool {
+	return s.getCollectIndex().collect[actionId]
+}
+
+// 节点本身或者沿可通的路径往下是否有汇聚节点
+func (s *Session) reachCollectAction(actionId string) bool {
+	return s.getCollectIndex().reach[actionId]
+}
+
+// 获取汇聚节点的等待状态，组或者循环的每次迭代分别等待。
+// 恢复执行时节点在同一次迭代中已经有执行记录的，执行前到达的连入路径视为已经使用；
+// 节点在待执行列表中的视为已经执行，需要持有joinLock
+func (s *Session) getJoinState(actionId string, iteration int) *joinState {
+	key := fmt.Sprintf("%s#%d", actionId, iteration)
+	js, ok := s.joins[key]
+	if ok {
+		return js
+	}
+
+	js = &joinState{done: make(chan struct{}), since: make(map[string]*LinkStateModel)}
+	if st := s.Operation.GetLastActionState(actionId); st != nil && st.Iteration == iteration {
+		for _, link := range s.getCollectIndex().joinLinks[actionId] {
+			ls := s.Operation.GetLastLinkState(link.SourceId, link.TargetId)
+			if ls != nil && ls.Iteration == iteration && !ls.EndTime.After(st.BeginTime) {
+				js.since[link.SourceId] = ls
+			}
+		}
+		//上次执行的连入路径还没有全部到达
+		js.fired = len(js.since) < len(s.getCollectIndex().joinLinks[actionId])
+	}
+	for _, p := range s.Operation.GetRunningActions() {
+		if p.ActionId == actionId && p.Iteration == iteration {
+			js.fired = true
+		}
+	}
+	s.joins[key] = js
+	return js
+}
+
+// 汇聚节点执行或者确定为死路径
+func (js *joinState) fire() {
+	js.fired = true
+	close(js.done)
+}
+
+// 汇聚节点的连入路径都已经到达，重新开始等待，在环路中再次到达时可以再次执行。需要持有joinLock
+func (s *Session) resetJoinState(actionId string, iteration int) {
+	js := &joinState{done: make(chan struct{}), since: make(map[string]*LinkStateModel)}
+	for _, link := range s.getCollectIndex().joinLinks[actionId] {
+		js.since[link.SourceId] = s.Operation.GetLastLinkState(link.SourceId, link.TargetId)
+	}
+	s.joins[fmt.Sprintf("%s#%d", actionId, iteration)] = js
+}
+
+// 连接线执行完成，记录连接线状态并判断目标节点是否执行，返回nil表示不执行。
+// 汇聚节点按照汇聚方式判断，所有可通的连入路径都有结果（通过、失败或者跳过）后还没有满足条件时目标节点为死路径
+func (s *Session) arriveAction(param *LinkParam, linkState *LinkStateModel) *ActionParam {
+	flow := s.GetFlow()
+	passed := linkState.State == int(RESULT_SUCCESS) && linkState.IsSkip == 0
+	actionParam := &ActionParam{RuntimeId: param.RuntimeId, ActionId: param.TargetId, PreActionId: param.SourceId, Error: param.Error, GroupId: param.GroupId, Iteration: param.Iteration}
+
+	s.joinLock.Lock()
+	defer s.joinLock.Unlock()
+
+	s.Operation.AddLinkState(linkState)
+
+	action := flow.GetAction(param.TargetId)
+	if action == nil {
+		return nil
+	}
+	//进入组的路径，由组从起点节点开始执行
+	if group := flow.GetGroupByActionId(param.TargetId); group != nil && !group.HasMember(param.SourceId) {
+		return s.arriveGroup(group, actionParam, passed)
+	}
+	collect := s.isCollectAction(param.TargetId)
+	if passed && !collect {
+		return actionParam
+	}
+	//失败的路径，下游没有汇聚节点时不需要处理
+	if !passed && !s.reachCollectAction(param.TargetId) {
+		return nil
+	}
+
+	if !collect {
+		resolved, passedIds, _ := s.getIncomingLinkStates(param.TargetId, param.Iteration, nil)
+		//非汇聚节点已经在通过的路径到达时执行
+		if !resolved || len(passedIds) > 0 {
+			return nil
+		}
+		actionParam.IsSkip = 1
+		return actionParam
+	}
+
+	js := s.getJoinState(param.TargetId, param.Iteration)
+	resolved, passedIds, _ := s.getIncomingLinkStates(param.TargetId, param.Iteration, js.since)
+	if js.fired {
+		//已经执行，剩余的连入路径到达后重新开始等待
+		if resolved {
+			s.resetJoinState(param.TargetId, param.Iteration)
+		}
+		return nil
+	}
+
+	fire := false
+	switch action.GetCollectMode() {
+	case COLLECT_MODE_COUNT, COLLECT_MODE_FIRST:
+		need := action.CollectCount
+		if action.GetCollectMode() == COLLECT_MODE_FIRST || need <= 0 {
+			need = 1
+		}
+		fire = len(passedIds) >= need || resolved
+		if resolved && len(passedIds) < need {
+			passedIds = nil
+		}
+	case COLLECT_MODE_TIMEOUT:
+		fire = resolved
+		if !fire && !js.waiting {
+			js.waiting = true
+			s.waitJoinTimeout(action, js, actionParam)
+		}
+	default:
+		fire = resolved
+	}
+	if !fire {
+		return nil
+	}
+
+	actionParam = s.fireJoin(action, js, actionParam, passedIds)
+	if resolved {
+		s.resetJoinState(param.TargetId, param.Iteration)
+	}
+	return actionParam
+}
+
+// 到达进入组的路径。组按照汇聚处理，所有可通的进入路径都有结果后进入一次组，没有通过的路径时组为死路径。
+// 组内的起点节点在组结束后才会再次进入，需要持有joinLock
+func (s *Session) arriveGroup(group *GroupModel, actionParam *ActionParam, passed bool) *ActionParam {
+	//失败的路径，组只有一个进入路径并且下游没有汇聚节点时不需要处理
+	if !passed && !s.reachCollectAction(actionParam.ActionId) {
+		return nil
+	}
+
+	js := s.getJoinState(group.Id, actionParam.Iteration)
+	resolved, passedIds, _ := s.getIncomingLinkStates(group.Id, actionParam.Iteration, js.since)
+	if !resolved {
+		return nil
+	}
+	fired := js.fired
+	if !fired {
+		js.fire()
+	}
+	s.resetJoinState(group.Id, actionParam.Iteration)
+	if fired {
+		return nil
+	}
+
+	if len(passedIds) == 0 {
+		actionParam.IsSkip = 1
+		return actionParam
+	}
+	if arrayIndexOf(passedIds, actionParam.PreActionId) < 0 {
+		actionParam.PreActionId = passedIds[len(passedIds)-1]
+	}
+	return actionParam
+}
+
+// 汇聚节点执行，没有通过的路径时为死路径，需要持有joinLock
+func (s *Session) fireJoin(action *ActionModel, js *joinState, actionParam *ActionParam, passedIds []string) *ActionParam {
+	js.fire()
+
+	if len(passedIds) == 0 {
+		actionParam.IsSkip = 1
+		return actionParam
+	}
+	actionParam.CollectIds = passedIds
+	if arrayIndexOf(passedIds, actionParam.PreActionId) < 0 {
+		actionParam.PreActionId = passedIds[len(passedIds)-1]
+	}
+
+	//取消还没有结果的连入路径上正在执行的源节点，只取消同一个组和同一次迭代中的执行
+	if strings.ToLower(action.CollectCancel) == "true" {
+		_, _, pendingIds := s.getIncomingLinkStates(action.Id, actionParam.Iteration, js.since)
+		for _, sourceId := range pendingIds {
+			s.skipRunningAction(sourceId, actionParam.GroupId, actionParam.Iteration)
+		}
+	}
+	return actionParam
+}
+
+// 获取汇聚节点连入路径在同一次迭代中的结果，返回是否都有结果、通过的源节点ID和还没有结果的源节点ID。
+// since中为上次执行时已经使用的连入路径状态，视为还没有结果
+func (s *Session) getIncomingLinkStates(actionId string, iteration int, since map[string]*LinkStateModel) (bool, []string, []string) {
+	passedIds := make([]string, 0)
+	pendingIds := make([]string, 0)
+	for _, link := range s.getCollectIndex().joinLinks[actionId] {
+		st := s.Operation.GetLastLinkState(link.SourceId, link.TargetId)
+		if st == nil || st.Iteration != iteration || st == since[link.SourceId] {
+			pendingIds = append(pendingIds, link.SourceId)
+			continue
+		}
+		if st.State == int(RESULT_SUCCESS) && st.IsSkip == 0 {
+			passedIds = append(passedIds, link.SourceId)
+		}
+	}
+	return len(pendingIds) == 0, passedIds, pendingIds
+}
+
+// 等待汇聚超时，超时后按照已经通过的路径执行汇聚节点
+func (s *Session) waitJoinTimeout(action *ActionModel, js *joinState, param *ActionParam) {
+	timeout := action.GetCollectTimeout()
+	if timeout <= 0 {
+		return
+	}
+
+	//等待期间保持执行，组内的汇聚节点等待期间组不结束
+	s.Operation.WaitAdd(1)
+	s.addGroupPending(param.GroupId, param.Iteration)
+	go func() {
+		defer s.Operation.WaitDone()
+		defer s.leaveGroup(param.GroupId)
+
+		timer := time.NewTimer(time.Millisecond * time.Duration(timeout))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-js.done:
+			return
+		case <-s.stopCh:
+			return
+		case <-s.Ctx.Done():
+			return
+		}
+
+		s.joinLock.Lock()
+		if js.fired {
+			s.joinLock.Unlock()
+			return
+		}
+		_, passedIds, _ := s.getIncomingLinkStates(action.Id, param.Iteration, js.since)
+		actionParam := &ActionParam{RuntimeId: s.Id, ActionId: action.Id, GroupId: param.GroupId, Iteration: param.Iteration}
+		actionParam = s.fireJoin(action, js, actionParam, passedIds)
+		s.joinLock.Unlock()
+
+		s.AddLog_action_info(action.Name, action.Title, fmt.Sprintf("汇聚等待超时，通过的路径：%d", len(passedIds)))
+		s.ToAction(actionParam)
+	}()
+}
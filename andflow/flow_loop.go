@@ -0,0 +1,139 @@
+package andflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dop251/goja"
+)
+
+var ErrMaxVisits = errors.New("超过节点最多执行次数")
+
+// 设置了循环方式和循环条件时循环执行
+func isLoop(loop string, condition string) bool {
+	loop = strings.ToLower(loop)
+	return (loop == LOOP_WHILE || loop == LOOP_UNTIL) && len(strings.TrimSpace(condition)) > 0
+}
+
+// 执行循环条件脚本，脚本中通过getIteration()获取当前是第几次执行
+func evalLoopCondition(ctx context.Context, rts *goja.Runtime, condition string) (bool, error) {
+	stopInterrupt := InterruptScriptOnDone(ctx, rts)
+	defer stopInterrupt()
+
+	script := "function $loop(){\n" + condition + "\n}\n $loop();\n"
+	val, err := rts.RunString(script)
+	if err != nil {
+		return false, fmt.Errorf("循环条件脚本错误：%w", err)
+	}
+	if val == nil || goja.IsUndefined(val) || goja.IsNull(val) {
+		return false, nil
+	}
+	return val.ToBoolean(), nil
+}
+
+// 判断循环节点的第index次执行是否满足循环条件
+func (s *Session) checkActionLoop(param *ActionParam, index int) (bool, error) {
+	action := s.GetFlow().GetAction(param.ActionId)
+	//使用本次执行的参数，脚本中的sleep和cmd受节点执行时效限制
+	current := param.LoopIndex
+	param.LoopIndex = index
+	defer func() { param.LoopIndex = current }()
+
+	rts := goja.New()
+	rts.Set("flow", s.GetFlow())
+	rts.Set("action", action)
+	SetCommonActionScriptFunc(rts, s, param, nil)
+	return evalLoopCondition(s.GetActionContext(param), rts, action.LoopCondition)
+}
+
+// 循环节点第一次执行前设置执行次数，while循环不满足条件时返回false，节点不执行
+func (s *Session) startActionLoop(param *ActionParam) (bool, error) {
+	action := s.GetFlow().GetAction(param.ActionId)
+	if !action.IsLoop() || param.LoopIndex > 0 {
+		return true, nil
+	}
+	param.LoopIndex = 1
+	if strings.ToLower(action.Loop) != LOOP_WHILE {
+		return true, nil
+	}
+	return s.checkActionLoop(param, param.LoopIndex)
+}
+
+// 循环节点执行成功后判断是否继续循环，继续时返回下一次执行的参数
+func (s *Session) nextActionLoop(param *ActionParam) (*ActionParam, error) {
+	action := s.GetFlow().GetAction(param.ActionId)
+	if !action.IsLoop() {
+		return nil, nil
+	}
+
+	var next bool
+	var err error
+	if strings.ToLower(action.Loop) == LOOP_WHILE {
+		next, err = s.checkActionLoop(param, param.LoopIndex+1)
+	} else {
+		var done bool
+		done, err = s.checkActionLoop(param, param.LoopIndex)
+		next = !done
+	}
+	if err != nil || !next {
+		return nil, err
+	}
+
+	p := *param
+	p.LoopIndex = param.LoopIndex + 1
+	p.Cmd = 0
+	return &p, nil
+}
+
+// 判断组的第index次执行是否满足循环条件
+func (s *Session) checkGroupLoop(scope *groupScope, index int) (bool, error) {
+	rts := goja.New()
+	rts.Set("flow", s.GetFlow())
+	rts.Set("group", scope.group)
+	rts.Set("getIteration", func(call goja.FunctionCall) goja.Value {
+		return rts.ToValue(index)
+	})
+	SetCommonScriptFunc(rts, s)
+	return evalLoopCondition(scope.ctx, rts, scope.group.LoopCondition)
+}
+
+// 组的循环条件脚本错误，组失败。组没有离开组的错误路径时流程失败
+func (s *Session) failGroupLoop(scope *groupScope, err error) {
+	s.groupLock.Lock()
+	if scope.failures == 0 {
+		scope.err = err.Error()
+	}
+	scope.failures++
+	s.groupLock.Unlock()
+
+	if !s.hasGroupErrorExit(scope.group.Id) {
+		atomic.AddInt32(&s.failures, 1)
+	}
+}
+
+// 记录节点的执行次数，超过最多执行次数时返回错误。恢复执行时从已有的执行记录开始计算
+func (s *Session) visitAction(param *ActionParam) error {
+	action := s.GetFlow().GetAction(param.ActionId)
+	if action.MaxVisits <= 0 {
+		return nil
+	}
+
+	s.visitLock.Lock()
+	defer s.visitLock.Unlock()
+	if s.visits == nil {
+		s.visits = make(map[string]int)
+		for _, st := range s.Operation.Snapshot().ActionStates {
+			if st.IsSkip == 0 && st.IsCompensate == 0 {
+				s.visits[st.ActionId]++
+			}
+		}
+	}
+	s.visits[action.Id]++
+	if s.visits[action.Id] > action.MaxVisits {
+		return fmt.Errorf("%w：%d", ErrMaxVisits, action.MaxVisits)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package andflow
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 最新版本
+const FLOW_VERSION_LATEST = "latest"
+
+// 没有设置版本的流程加入仓库时使用的版本
+const FLOW_VERSION_DEFAULT = "1"
+
+var ErrFlowNotFound = errors.New("流程不存在")
+var ErrFlowExists = errors.New("流程版本已经存在")
+var ErrFlowVersion = errors.New("流程版本错误")
+
+// 流程仓库，按照流程编码和版本获取流程定义
+type FlowRepository interface {
+	Get(code string, version string) (*FlowModel, error) //version为空或者latest时获取最新版本
+	Versions(code string) ([]string, error)              //流程的所有版本，从旧到新
+	Codes() []string                                     //所有流程编码
+}
+
+// 内存流程仓库，每个流程编码保存多个版本
+type MemoryFlowRepository struct {
+	lock  sync.RWMutex
+	flows map[string]map[string]*FlowModel
+}
+
+func CreateMemoryFlowRepository() *MemoryFlowRepository {
+	return &MemoryFlowRepository{flows: make(map[string]map[string]*FlowModel)}
+}
+
+// 添加流程，版本为空时使用默认版本。相同编码和版本的流程已经存在时返回错误，不替换
+func (r *MemoryFlowRepository) Put(flow *FlowModel) error {
+	version := strings.TrimSpace(flow.Version)
+	if len(version) == 0 {
+		version = FLOW_VERSION_DEFAULT
+	}
+	if version == FLOW_VERSION_LATEST {
+		return fmt.Errorf("%w: %s@%s", ErrFlowVersion, flow.Code, version)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	versions, ok := r.flows[flow.Code]
+	if !ok {
+		versions = make(map[string]*FlowModel)
+		r.flows[flow.Code] = versions
+	}
+	if _, ok := versions[version]; ok {
+		return fmt.Errorf("%w: %s@%s", ErrFlowExists, flow.Code, version)
+	}
+	flow.Version = version
+	versions[version] = flow
+	return nil
+}
+
+func (r *MemoryFlowRepository) Get(code string, version string) (*FlowModel, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	versions, ok := r.flows[code]
+	if !ok || len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrFlowNotFound, code)
+	}
+	if len(version) == 0 || version == FLOW_VERSION_LATEST {
+		list := sortFlowVersions(versions)
+		return versions[list[len(list)-1]], nil
+	}
+	flow, ok := versions[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s@%s", ErrFlowNotFound, code, version)
+	}
+	return flow, nil
+}
+
+func (r *MemoryFlowRepository) Versions(code string) ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	versions, ok := r.flows[code]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFlowNotFound, code)
+	}
+	return sortFlowVersions(versions), nil
+}
+
+func (r *MemoryFlowRepository) Codes() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	codes := make([]string, 0, len(r.flows))
+	for code := range r.flows {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// 从文件系统加载所有json流程文件，可以是目录或者embed.FS。流程编码为空时使用文件名，相同编码和版本的流程重复时返回错误
+func LoadFlowRepository(fsys fs.FS) (*MemoryFlowRepository, error) {
+	repo := CreateMemoryFlowRepository()
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.ToLower(path.Ext(p)) != ".json" {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		flow, err := ParseFlow(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if len(flow.Code) == 0 {
+			flow.Code = strings.TrimSuffix(path.Base(p), path.Ext(p))
+		}
+		if err := repo.Put(flow); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// 从目录加载流程
+func LoadFlowDir(dir string) (*MemoryFlowRepository, error) {
+	return LoadFlowRepository(os.DirFS(dir))
+}
+
+// 版本从旧到新排序，按照点分隔逐段比较，数字按照大小比较
+func sortFlowVersions(versions map[string]*FlowModel) []string {
+	list := make([]string, 0, len(versions))
+	for v := range versions {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return CompareFlowVersion(list[i], list[j]) < 0
+	})
+	return list
+}
+
+// 比较版本，a旧于b返回-1，相同返回0，a新于b返回1
+func CompareFlowVersion(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i >= len(as) {
+			return -1
+		}
+		if i >= len(bs) {
+			return 1
+		}
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr == nil && berr == nil {
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+var flowRepositoryLock sync.RWMutex
+var flowRepository FlowRepository
+var registedFlows = CreateMemoryFlowRepository()
+
+// 设置流程仓库，子流程和按照编码执行时使用，为空时使用RegistFlow注册的流程
+func SetFlowRepository(repo FlowRepository) {
+	flowRepositoryLock.Lock()
+	defer flowRepositoryLock.Unlock()
+	flowRepository = repo
+}
+
+func GetFlowRepository() FlowRepository {
+	flowRepositoryLock.RLock()
+	defer flowRepositoryLock.RUnlock()
+	if flowRepository == nil {
+		return registedFlows
+	}
+	return flowRepository
+}
+
+// 注册流程到内置的内存仓库，通过SetFlowRepository设置了其他仓库时不使用。相同编码和版本已经注册时返回错误
+func RegistFlow(flow *FlowModel) error {
+	return registedFlows.Put(flow)
+}
+
+// 根据流程编码获取最新版本的流程，不存在时返回nil
+func GetFlowByCode(code string) *FlowModel {
+	flow, err := GetFlowRepository().Get(code, FLOW_VERSION_LATEST)
+	if err != nil {
+		return nil
+	}
+	return flow
+}
+
+// 按照编码和版本创建运行时，运行时记录使用的版本
+func CreateRuntimeByCode(code string, version string, param map[string]interface{}) (*RuntimeModel, error) {
+	flow, err := GetFlowRepository().Get(code, version)
+	if err != nil {
+		return nil, err
+	}
+	return CreateRuntime(flow, param), nil
+}
+
+// 按照编码和版本执行流程，version为空或者latest时使用最新版本
+func ExecuteFlowByCode(code string, version string, param map[string]interface{}, timeout int64) (*RuntimeModel, error) {
+	runtime, err := CreateRuntimeByCode(code, version, param)
+	if err != nil {
+		return nil, err
+	}
+	return ExecuteRuntime(runtime, timeout), nil
+}
+
+// 恢复执行前加载运行时使用的流程定义，运行时已经保存了流程定义时不变，否则按照记录的编码和版本从仓库加载，
+// 保证恢复执行的运行时使用开始时的版本。没有记录版本的运行时使用默认版本，不使用最新版本
+func LoadRuntimeFlow(repo FlowRepository, runtime *RuntimeModel) error {
+	if runtime.Flow != nil {
+		return nil
+	}
+	if repo == nil {
+		repo = GetFlowRepository()
+	}
+	version := runtime.FlowVersion
+	if len(version) == 0 {
+		version = FLOW_VERSION_DEFAULT
+	}
+	flow, err := repo.Get(runtime.FlowCode, version)
+	if err != nil {
+		return err
+	}
+	runtime.Flow = flow
+	return nil
+}
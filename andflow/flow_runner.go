@@ -1,6 +1,7 @@
 package andflow
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,6 +22,29 @@ type FlowRunner interface {
 	OnTimeout(s *Session)
 }
 
+// 支持上下文的流程执行器，节点的上下文带有执行时效、运行时ID和节点ID
+type ContextFlowRunner interface {
+	FlowRunner
+	ExecuteLinkContext(ctx context.Context, s *Session, param *LinkParam, state *LinkStateModel) (Result, error)
+	ExecuteActionContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error)
+}
+
+// 执行连接线，不支持上下文的流程执行器忽略上下文
+func executeFlowRunnerLink(ctx context.Context, runner FlowRunner, s *Session, param *LinkParam, state *LinkStateModel) (Result, error) {
+	if r, ok := runner.(ContextFlowRunner); ok {
+		return r.ExecuteLinkContext(ctx, s, param, state)
+	}
+	return runner.ExecuteLink(s, param, state)
+}
+
+// 执行节点，不支持上下文的流程执行器忽略上下文
+func executeFlowRunnerAction(ctx context.Context, runner FlowRunner, s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	if r, ok := runner.(ContextFlowRunner); ok {
+		return r.ExecuteActionContext(ctx, s, param, state)
+	}
+	return runner.ExecuteAction(s, param, state)
+}
+
 type CommonFlowRunner struct {
 	ActionScriptFunc   func(rts *goja.Runtime, s *Session, param *ActionParam, state *ActionStateModel)
 	LinkScriptFunc     func(rts *goja.Runtime, s *Session, param *LinkParam, state *LinkStateModel)
@@ -58,6 +82,10 @@ func (r *CommonFlowRunner) SetTimeoutFunc(e func(s *Session)) {
 }
 
 func (r *CommonFlowRunner) ExecuteLink(s *Session, param *LinkParam, state *LinkStateModel) (Result, error) {
+	return r.ExecuteLinkContext(s.Ctx, s, param, state)
+}
+
+func (r *CommonFlowRunner) ExecuteLinkContext(ctx context.Context, s *Session, param *LinkParam, state *LinkStateModel) (Result, error) {
 	link := s.GetFlow().GetLinkBySourceIdAndTargetId(param.SourceId, param.TargetId)
 	sc := link.Filter
 	if len(strings.Trim(sc, " ")) == 0 {
@@ -73,6 +101,9 @@ func (r *CommonFlowRunner) ExecuteLink(s *Session, param *LinkParam, state *Link
 
 	SetCommonLinkScriptFunc(rts, s, param, state)
 
+	stopInterrupt := InterruptScriptOnDone(ctx, rts)
+	defer stopInterrupt()
+
 	script := "function $exec(){\n" + sc + "\n}\n $exec();\n"
 	val, err := rts.RunString(script)
 
@@ -86,6 +117,10 @@ func (r *CommonFlowRunner) ExecuteLink(s *Session, param *LinkParam, state *Link
 }
 
 func (r *CommonFlowRunner) ExecuteAction(s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	return r.ExecuteActionContext(s.GetActionContext(param), s, param, state)
+}
+
+func (r *CommonFlowRunner) ExecuteActionContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
 	var res Result = RESULT_SUCCESS
 	var err error
 
@@ -106,6 +141,10 @@ func (r *CommonFlowRunner) ExecuteAction(s *Session, param *ActionParam, state *
 
 	SetCommonActionScriptFunc(rts, s, param, state)
 
+	//节点超时或者流程结束的时候中断脚本
+	stopInterrupt := InterruptScriptOnDone(ctx, rts)
+	defer stopInterrupt()
+
 	//1.执行过滤脚本
 	if len(strings.Trim(action.ScriptBefore, " ")) > 0 {
 
@@ -185,7 +224,7 @@ func (r *CommonFlowRunner) ExecuteAction(s *Session, param *ActionParam, state *
 				s.SetParam(action.IteratorItem, item)
 			}
 
-			res, err = runner.Execute(s, param, state)
+			res, err = executeActionRunner(ctx, s, runner, param, state)
 
 			//如果异常 或者执行失败
 			if err != nil || res == RESULT_FAILURE {
@@ -198,6 +237,10 @@ func (r *CommonFlowRunner) ExecuteAction(s *Session, param *ActionParam, state *
 
 				//执行异常处理脚本
 				if len(strings.Trim(action.ScriptError, " ")) > 0 {
+					//节点超时后仍然执行异常处理脚本
+					stopInterrupt()
+					rts.ClearInterrupt()
+
 					script_error := "function $exec(){\n" + action.ScriptError + "\n}\n $exec();\n"
 					_, err_err := rts.RunString(script_error)
 					if err_err != nil {
@@ -0,0 +1,87 @@
+package andflow
+
+import "sync"
+
+var poolSize = 20 //默认工作协程数量
+
+// 设置默认的工作协程数量，对之后创建的会话生效
+func SetPoolSize(size int) {
+	if size > 0 {
+		poolSize = size
+	}
+}
+
+func GetPoolSize() int {
+	return poolSize
+}
+
+// 有界工作协程池，工作协程按需创建，最多size个。
+// 任务队列不限制长度，执行中的节点分发后续连接线的时候不会阻塞。
+type scheduler struct {
+	size    int
+	lock    sync.Mutex
+	cond    *sync.Cond
+	tasks   []func()
+	workers int //工作协程数量
+	idle    int //空闲工作协程数量
+	closed  bool
+}
+
+func newScheduler(size int) *scheduler {
+	if size <= 0 {
+		size = 1
+	}
+	p := &scheduler{size: size, tasks: make([]func(), 0)}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// 提交任务，已经停止返回false
+func (p *scheduler) submit(task func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	p.tasks = append(p.tasks, task)
+	if p.idle == 0 && p.workers < p.size {
+		p.workers++
+		go p.work()
+	} else {
+		p.cond.Signal()
+	}
+	return true
+}
+
+func (p *scheduler) work() {
+	for {
+		p.lock.Lock()
+		for len(p.tasks) == 0 && !p.closed {
+			p.idle++
+			p.cond.Wait()
+			p.idle--
+		}
+		if len(p.tasks) == 0 {
+			p.workers--
+			p.lock.Unlock()
+			return
+		}
+		task := p.tasks[0]
+		p.tasks[0] = nil
+		p.tasks = p.tasks[1:]
+		p.lock.Unlock()
+
+		task()
+	}
+}
+
+// 停止，不再接受新任务，工作协程执行完队列中的任务后退出
+func (p *scheduler) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
@@ -7,60 +7,173 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var chan_len = 100
+var ErrActionTimeout = errors.New("节点执行超时")
 
 // 流程会话
 type Session struct {
 	Id string
 
-	Ctx           context.Context
-	Operation     RuntimeOperation
-	Router        FlowRouter
-	Runner        FlowRunner
-	ActionChanMap sync.Map //[string]chan *ActionParam
-	LinkChanMap   sync.Map //map[string]chan *LinkParam
+	Ctx       context.Context
+	Operation RuntimeOperation
+	Router    FlowRouter
+	Runner    FlowRunner
+	PoolSize  int //工作协程数量，为0时使用默认设置
+
+	joinLock    sync.Mutex            //连接线到达节点时，记录状态和判断节点是否执行
+	joins       map[string]*joinState //汇聚节点的等待状态
+	onceLock    sync.Mutex
+	onceActions map[string]bool //只执行一次的节点，已经占用执行的记录
+	groupLock   sync.Mutex
+	groups      map[string]*groupScope //正在执行的组
+	visitLock   sync.Mutex
+	visits      map[string]int //节点的执行次数，设置了最多执行次数时记录
+	collectOnce sync.Once
+	collects    *collectIndex //汇聚节点的索引
+
+	actionCtxMap sync.Map //map[*ActionParam]*actionContext 正在执行的节点上下文
+
+	cmdLock       sync.Mutex
+	pausedActions []*ActionParam //暂停期间等待执行的节点
+	pausedLinks   []*LinkParam   //暂停期间等待执行的连接线
+
+	cancel       context.CancelFunc
+	cancelReason string
+	done         chan struct{} //执行结束时关闭
+	watchDone    chan struct{} //监控协程结束时关闭
+	stopCh       chan struct{} //停止时关闭
+	stopOnce     sync.Once
+	endLock      sync.Mutex
+	ended        bool //执行结束或者监控协程已经处理超时和取消，只允许一方设置结束状态
+
+	scheduler *scheduler
+	failures  int32 //本次执行失败的节点和连接线数量
 }
 
-func (s *Session) getActionChan(actionId string) chan *ActionParam {
+// 正在执行的节点上下文
+type actionContext struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	skipped int32 //被汇聚节点取消，按照跳过处理
 
-	c, ok := s.ActionChanMap.Load(actionId)
-	if ok && c != nil {
-		return c.(chan *ActionParam)
+	lock    sync.Mutex
+	attempt context.Context //按照重试策略执行时当前尝试的上下文
+}
+
+// 获取节点当前的执行上下文，重试时为当前尝试的上下文
+func (c *actionContext) current() context.Context {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.attempt != nil {
+		return c.attempt
 	}
+	return c.ctx
+}
 
-	return nil
+// 节点执行上下文的键，每次执行使用不同的参数，循环或者从同一个节点再次到达时不会相互覆盖
+func actionContextKey(param *ActionParam) interface{} {
+	return param
 }
 
-func (s *Session) setActionChan(actionId string, c chan *ActionParam) {
-	s.ActionChanMap.Store(actionId, c)
+// 创建节点执行上下文，节点设置了执行时效就在会话上下文的基础上增加超时。
+// 设置了重试策略时执行时效用于每次尝试，节点的执行时效包含所有尝试和重试间隔
+func (s *Session) createActionContext(param *ActionParam) (context.Context, context.CancelFunc) {
+	timeout := int64(0)
+	action := s.GetFlow().GetAction(param.ActionId)
+	if action != nil {
+		timeout = action.getRetryTimeout()
+	}
+	//组内的节点受组执行时效限制
+	if ctx := s.getGroupContext(param.GroupId); ctx != nil {
+		return s.createActionContextFrom(ctx, param, timeout)
+	}
+	return s.createActionContextFrom(s.Ctx, param, timeout)
 }
 
-func (s *Session) delActionChan(actionId string) {
+// 在指定的上下文基础上创建节点执行上下文，timeout为执行时效（毫秒），为0时不限制
+func (s *Session) createActionContextFrom(parent context.Context, param *ActionParam, timeout int64) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
 
-	s.ActionChanMap.Delete(actionId)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, time.Millisecond*time.Duration(timeout))
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	ctx = context.WithValue(ctx, contextKeyActionId, param.ActionId)
+	ctx = context.WithValue(ctx, contextKeyPreActionId, param.PreActionId)
 
-}
+	key := actionContextKey(param)
+	actx := &actionContext{ctx: ctx, cancel: cancel}
+	s.actionCtxMap.Store(key, actx)
 
-func (s *Session) getLinkChan(sourceId string, targetId string) chan *LinkParam {
+	return ctx, func() {
+		//只删除本次执行的上下文
+		if c, ok := s.actionCtxMap.Load(key); ok && c == actx {
+			s.actionCtxMap.Delete(key)
+		}
+		cancel()
+	}
+}
 
-	c, ok := s.LinkChanMap.Load(sourceId + "_" + targetId)
+// 获取节点执行上下文，节点超时或者会话结束的时候上下文结束
+func (s *Session) GetActionContext(param *ActionParam) context.Context {
+	c, ok := s.actionCtxMap.Load(actionContextKey(param))
 	if ok && c != nil {
-		return c.(chan *LinkParam)
+		return c.(*actionContext).current()
 	}
-
-	return nil
+	return s.Ctx
 }
 
-func (s *Session) setLinkChan(sourceId string, targetId string, c chan *LinkParam) {
-	s.LinkChanMap.Store(sourceId+"_"+targetId, c)
+// 创建一次尝试的上下文，执行期间GetActionContext返回尝试的上下文
+func (s *Session) createAttemptContext(ctx context.Context, param *ActionParam, timeout int64) (context.Context, context.CancelFunc) {
+	var attempt context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		attempt, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(timeout))
+	} else {
+		attempt, cancel = context.WithCancel(ctx)
+	}
+
+	c, ok := s.actionCtxMap.Load(actionContextKey(param))
+	if !ok {
+		return attempt, cancel
+	}
+	actx := c.(*actionContext)
+	actx.lock.Lock()
+	actx.attempt = attempt
+	actx.lock.Unlock()
+
+	return attempt, func() {
+		actx.lock.Lock()
+		if actx.attempt == attempt {
+			actx.attempt = nil
+		}
+		actx.lock.Unlock()
+		cancel()
+	}
 }
-func (s *Session) delLinkChan(sourceId string, targetId string) {
 
-	s.LinkChanMap.Delete(sourceId + "_" + targetId)
+// 取消节点在指定组和迭代中正在进行的执行，节点按照跳过处理
+func (s *Session) skipRunningAction(actionId string, groupId string, iteration int) {
+	s.actionCtxMap.Range(func(key, value interface{}) bool {
+		c := value.(*actionContext)
+		param := key.(*ActionParam)
+		if param.ActionId == actionId && param.GroupId == groupId && param.Iteration == iteration {
+			atomic.StoreInt32(&c.skipped, 1)
+			c.cancel()
+		}
+		return true
+	})
+}
 
+// 节点执行是否被取消跳过
+func (s *Session) isActionSkipped(param *ActionParam) bool {
+	c, ok := s.actionCtxMap.Load(actionContextKey(param))
+	return ok && atomic.LoadInt32(&c.(*actionContext).skipped) == 1
 }
 
 func (s *Session) GetFlow() *FlowModel {
@@ -107,6 +220,14 @@ func (s *Session) AddLog_link_info(name, title, content string) {
 	s.Operation.AddLog("info", "link", name, title, content)
 }
 
+func (s *Session) AddLog_group_error(name, title, content string) {
+	s.Operation.AddLog("error", "group", name, title, content)
+}
+
+func (s *Session) AddLog_group_info(name, title, content string) {
+	s.Operation.AddLog("info", "group", name, title, content)
+}
+
 func (s *Session) createActionState(actionId string, preActionId string) *ActionStateModel {
 	flow := s.GetFlow()
 
@@ -147,78 +268,86 @@ func (s *Session) createLinkState(sourceId string, targetId string) *LinkStateMo
 	return state
 }
 
-// 监控协程
+// 监控协程，等待停止、超时或者取消
 func (s *Session) watch() {
+	defer close(s.watchDone)
 
-	for {
+	select {
+	case <-s.stopCh:
+		return
+	case <-s.Ctx.Done():
+	}
 
-		select {
-		case <-s.Ctx.Done():
-			s.Stop()
-			s.AddLog_flow_info(s.GetFlow().Code, s.GetFlow().Name, "timeout")
-			log.Println("timeout, suspend")
-			s.Runner.OnTimeout(s)
-			return
-		default:
-			if s.Operation.GetCmd() == CMD_STOP {
-				return
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
+	//已经正常结束
+	select {
+	case <-s.stopCh:
+		return
+	default:
+	}
+	if !s.claimEnd() {
+		return
+	}
+
+	s.Stop()
+	if s.Ctx.Err() == context.DeadlineExceeded {
+		s.AddLog_flow_info(s.GetFlow().Code, s.GetFlow().Name, "timeout")
+		log.Println("timeout, suspend")
+		s.setState(FLOW_STATE_TIMEOUT)
+		s.Runner.OnTimeout(s)
+	} else {
+		reason := s.getCancelReason()
+		s.AddLog_flow_info(s.GetFlow().Code, s.GetFlow().Name, "cancel: "+reason)
+		log.Println("cancel, suspend")
+		s.Operation.SetMessage(reason)
+		s.setState(FLOW_STATE_CANCEL)
 	}
 }
 
-func CreateSession(context context.Context, operation RuntimeOperation, router FlowRouter, runner FlowRunner) *Session {
+func CreateSession(ctx context.Context, operation RuntimeOperation, router FlowRouter, runner FlowRunner) *Session {
 	session := &Session{}
 	// uid, _ := uuid.NewV4()
 	// id := strings.ReplaceAll(uid.String(), "-", "")
 	session.Id = operation.GetRuntime().Id
-	session.Ctx = context
+	session.Ctx, session.cancel = context.WithCancel(context.WithValue(ctx, contextKeyRuntimeId, session.Id))
+	session.done = make(chan struct{})
+	session.watchDone = make(chan struct{})
+	session.stopCh = make(chan struct{})
 	session.Router = router
 	session.Runner = runner
 
 	session.Operation = operation
-	//actionid: RuntimeActionParam
-	session.ActionChanMap = sync.Map{}
-	//make(map[string]chan *ActionParam, 0)
 
-	//sourceId_targetId: RuntimeLinkParam
-	session.LinkChanMap = sync.Map{}
-	//make(map[string]chan *LinkParam, 0)
+	session.onceActions = make(map[string]bool)
+	session.joins = make(map[string]*joinState)
+	session.groups = make(map[string]*groupScope)
 
 	return session
 }
 
-func (s *Session) startChannel() {
+func (s *Session) startScheduler() {
 
 	go s.watch()
 
-	flow := s.GetFlow()
-
-	w_action := &sync.WaitGroup{}
-	for _, a := range flow.Actions {
-		w_action.Add(1)
-		go s.runProcessAction(a.Id, w_action)
-	}
-
-	w_link := &sync.WaitGroup{}
-	for _, l := range flow.Links {
-		w_link.Add(1)
-		go s.runProcessLink(l.SourceId, l.TargetId, w_link)
+	size := s.PoolSize
+	if size <= 0 {
+		size = GetPoolSize()
 	}
-
-	w_action.Wait()
-	w_link.Wait()
+	s.scheduler = newScheduler(size)
 
 }
 
 func (s *Session) Execute() {
+	defer func() {
+		s.cancel()
+		close(s.done)
+	}()
 
-	s.startChannel()
-	defer s.stopChannel()
+	s.startScheduler()
+	defer s.stopScheduler()
 
 	s.Operation.SetBegin()
 	defer s.Operation.SetEnd()
+	s.setState(FLOW_STATE_RUNNING)
 
 	s.Operation.SetCmd(CMD_START)
 
@@ -244,8 +373,7 @@ func (s *Session) Execute() {
 	//第一次执行或者从头执行。
 	if firstRun {
 		//清空状态
-		s.Operation.GetRuntime().ActionStates = make([]*ActionStateModel, 0)
-		s.Operation.GetRuntime().LinkStates = make([]*LinkStateModel, 0)
+		s.Operation.ClearStates()
 
 		runtimeId := s.Operation.GetRuntime().Id
 
@@ -259,123 +387,269 @@ func (s *Session) Execute() {
 
 	s.waitComplete()
 
-}
+	//超时或者取消，等待监控协程记录完成；正常结束后监控协程不再设置超时或者取消
+	if s.Ctx.Err() != nil || !s.claimEnd() {
+		<-s.watchDone
+	}
 
-func (s *Session) Stop() {
-	s.Operation.SetCmd(CMD_STOP)
-}
+	s.setEndState(firstRun)
 
-func (s *Session) waitComplete() {
-	s.Operation.Wait()
+	//失败、超时或者取消，撤销已经完成的节点
+	switch s.Operation.GetState() {
+	case FLOW_STATE_FAILED, FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL:
+		s.compensate()
+	}
 }
 
-func (s *Session) stopChannel() {
+// 占用结束状态的设置，执行结束和监控协程只有先到的一方可以设置
+func (s *Session) claimEnd() bool {
+	s.endLock.Lock()
+	defer s.endLock.Unlock()
+	if s.ended {
+		return false
+	}
+	s.ended = true
+	return true
+}
 
-	s.Stop()
-	flow := s.GetFlow()
+// 设置流程状态，不允许的状态转换记录错误日志
+func (s *Session) setState(state int) {
+	if err := s.Operation.SetState(state); err != nil {
+		log.Println(err)
+		s.AddLog_flow_error(s.GetFlow().Code, s.GetFlow().Name, err.Error())
+	}
+}
 
-	for _, a := range flow.Actions {
-		s.stopProcessAction(a.Id)
+// 执行结束时根据待执行的内容和异常设置流程状态，超时和取消已经由监控协程设置
+func (s *Session) setEndState(firstRun bool) {
+	switch s.Operation.GetState() {
+	case FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL:
+		return
 	}
-	for _, l := range flow.Links {
-		s.stopProcessLink(l.SourceId, l.TargetId)
+
+	if len(s.Operation.GetRunningActions()) > 0 || len(s.Operation.GetRunningLinks()) > 0 {
+		s.setState(FLOW_STATE_WAITING)
+	} else if atomic.LoadInt32(&s.failures) > 0 || (!firstRun && s.Operation.GetError() == 1) {
+		s.setState(FLOW_STATE_FAILED)
+	} else {
+		s.setState(FLOW_STATE_COMPLETED)
 	}
+}
 
-	for _, a := range flow.Actions {
-		c := s.getActionChan(a.Id)
-		if c != nil {
-			close(c)
-		}
-		s.delActionChan(a.Id)
+func (s *Session) Stop() {
+	s.cmdLock.Lock()
+	paused := s.Operation.GetCmd() == CMD_PAUSE
+	s.Operation.SetCmd(CMD_STOP)
+	s.pausedActions = nil
+	s.pausedLinks = nil
+	s.cmdLock.Unlock()
+
+	s.stopOnce.Do(func() { close(s.stopCh) })
 
+	//释放暂停时保持的等待
+	if paused {
+		s.Operation.WaitDone()
 	}
-	for _, l := range flow.Links {
-		c := s.getLinkChan(l.SourceId, l.TargetId)
-		if c != nil {
-			close(c)
-		}
-		s.delLinkChan(l.SourceId, l.TargetId)
+}
+
+// 取消执行，原因记录在运行时的信息中
+func (s *Session) Cancel(reason string) {
+	s.cmdLock.Lock()
+	if len(s.cancelReason) == 0 {
+		s.cancelReason = reason
 	}
+	s.cmdLock.Unlock()
+
+	s.cancel()
+}
 
+func (s *Session) getCancelReason() string {
+	s.cmdLock.Lock()
+	defer s.cmdLock.Unlock()
+	return s.cancelReason
 }
 
-// 节点处理
-func (s *Session) runProcessAction(actionId string, w *sync.WaitGroup) {
+// 执行结束时关闭的通道
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// 暂停执行，不再分发新的节点和连接线，正在执行的继续执行完成，等待执行的保留在RunningActions和RunningLinks中
+func (s *Session) Pause() bool {
+	s.cmdLock.Lock()
+	defer s.cmdLock.Unlock()
 
-	c := s.getActionChan(actionId)
-	if c == nil {
-		c = make(chan *ActionParam, chan_len)
-		s.setActionChan(actionId, c)
+	if s.Operation.GetCmd() != CMD_START {
+		return false
 	}
-	w.Done()
+	//暂停期间保持等待，避免执行结束
+	s.Operation.WaitAdd(1)
+	s.Operation.SetCmd(CMD_PAUSE)
+	s.setState(FLOW_STATE_PAUSED)
+	s.AddLog_flow_info(s.GetFlow().Code, s.GetFlow().Name, "pause")
+	return true
+}
 
-EVENT_LOOP:
-	for {
-		select {
-		// 消息通道中有消息则执行，否则堵塞
-		case param := <-c:
-			if param.Cmd == 1 {
-				break EVENT_LOOP
-			}
+// 恢复执行，继续分发暂停期间等待执行的节点和连接线
+func (s *Session) Resume() bool {
+	s.cmdLock.Lock()
+	if s.Operation.GetCmd() != CMD_PAUSE {
+		s.cmdLock.Unlock()
+		return false
+	}
+	s.Operation.SetCmd(CMD_START)
+	s.setState(FLOW_STATE_RUNNING)
+	actions := s.pausedActions
+	links := s.pausedLinks
+	s.pausedActions = nil
+	s.pausedLinks = nil
+	s.cmdLock.Unlock()
 
-			s.ExecuteAction(param)
+	s.AddLog_flow_info(s.GetFlow().Code, s.GetFlow().Name, "resume")
 
-		}
+	for _, param := range actions {
+		s.ToAction(param)
+		s.resumeGroupPending(param.GroupId)
+	}
+	for _, param := range links {
+		s.ToLink(param)
+		s.resumeGroupPending(param.GroupId)
 	}
+
+	//释放暂停时保持的等待
+	s.Operation.WaitDone()
+	return true
 }
 
-func (s *Session) stopProcessAction(actionId string) {
-	c := s.getActionChan(actionId)
-	if c == nil {
-		return
-	}
+func (s *Session) waitComplete() {
+	s.Operation.Wait()
+}
 
-	param := &ActionParam{Cmd: 1}
+func (s *Session) stopScheduler() {
+
+	s.Stop()
+	s.scheduler.stop()
 
-	c <- param
 }
+
 func (s *Session) ToAction(param *ActionParam) {
+	//到达组内的节点，从组的起点节点进入组
+	if s.enterGroup(param) {
+		return
+	}
+	s.addGroupPending(param.GroupId, param.Iteration)
+
 	if s.Router != nil {
 		// 添加正在执行的节点记录
 		s.Operation.AddRunningAction(param)
 
-		if s.Operation.GetCmd() == CMD_STOP {
+		s.cmdLock.Lock()
+		switch s.Operation.GetCmd() {
+		case CMD_STOP:
+			s.cmdLock.Unlock()
+			return
+		case CMD_PAUSE:
+			s.pausedActions = append(s.pausedActions, param)
+			s.cmdLock.Unlock()
 			return
 		}
 		s.Operation.WaitAdd(1)
+		s.cmdLock.Unlock()
+
 		s.Router.RouteAction(s, param)
 	}
 }
 
+// 将节点提交到工作协程池执行
 func (s *Session) PushAction(param *ActionParam) bool {
 
-	c := s.getActionChan(param.ActionId)
-	if c == nil {
+	ok := s.scheduler.submit(func() {
+		s.ExecuteAction(param)
+	})
+	if !ok {
 		s.Operation.WaitDone()
 		return false
 	}
-
-	c <- param
 	return true
 }
 
 func (s *Session) ExecuteAction(param *ActionParam) {
 	defer s.Operation.WaitDone() //确认节点执行完成
+	defer s.leaveGroup(param.GroupId)
 
 	var err error
 	var res Result = RESULT_SUCCESS
+	var chosen *LinkModel //排他路由选中的路径
 	actionState := s.createActionState(param.ActionId, param.PreActionId)
+	actionState.GroupId = param.GroupId
+	actionState.Iteration = param.Iteration
+	if len(param.CollectIds) > 0 {
+		actionState.CollectIds = append([]string{}, param.CollectIds...)
+	}
 
 	defer func() {
 		s.Runner.OnActionExecuted(s, param, actionState, res, err)
 	}()
 
-	if s.Runner != nil {
-		res, err = s.Runner.ExecuteAction(s, param, actionState)
-		if err != nil || res == RESULT_FAILURE {
+	//死路径上的节点不执行，继续往下传递跳过标记
+	if param.IsSkip == 1 {
+		res = RESULT_REJECT
+		s.skipAction(param, actionState, "死路径，跳过")
+		s.skipNextLinks(param)
+		return
+	}
+
+	//只执行一次的节点，已经执行过就跳过，循环节点再次执行时不判断
+	if param.LoopIndex <= 1 && !s.acquireOnce(param.ActionId) {
+		res = RESULT_REJECT
+		s.skipAction(param, actionState, "节点只执行一次，跳过")
+		return
+	}
+
+	ctx, cancel := s.createActionContext(param)
+	defer cancel()
+
+	//超过最多执行次数时流程失败，不按照错误路径处理
+	fatal := false
+	run := true
+	if err = s.visitAction(param); err != nil {
+		fatal = true
+	} else {
+		//while循环第一次执行前判断循环条件
+		run, err = s.startActionLoop(param)
+		actionState.LoopIndex = param.LoopIndex
+	}
+
+	if err != nil {
+		res = RESULT_FAILURE
+		actionState.Error = err.Error()
+		s.AddLog_action_error(actionState.ActionName, actionState.ActionTitle, err.Error())
+	} else if !run {
+		//不满足循环条件，节点不执行，直接执行后续路径
+		s.AddLog_action_info(actionState.ActionName, actionState.ActionTitle, "不满足循环条件，不执行")
+	} else if gctx := s.getGroupContext(param.GroupId); gctx != nil && gctx.Err() == context.DeadlineExceeded {
+		//组已经超时，不再执行组内的节点
+		res, err = RESULT_FAILURE, ErrGroupTimeout
+		actionState.IsTimeout = 1
+		actionState.Error = err.Error()
+		s.AddLog_action_error(actionState.ActionName, actionState.ActionTitle, err.Error())
+	} else if s.Runner != nil {
+		res, err = executeFlowRunnerAction(ctx, s.Runner, s, param, actionState)
+
+		//汇聚节点已经执行，取消的节点按照跳过处理
+		if s.isActionSkipped(param) {
+			res = RESULT_REJECT
+			err = nil
+		} else if err != nil || res == RESULT_FAILURE {
 			if err == nil {
 				err = errors.New("节点返回错误")
 			}
+			//超时导致的失败，重试时为最后一次尝试超时
+			if ctx.Err() == context.DeadlineExceeded || isTimeoutError(err) {
+				err = ErrActionTimeout
+				actionState.IsTimeout = 1
+			}
+			actionState.Error = err.Error()
 
 			//错误回调
 			s.Runner.OnActionFailure(s, param, actionState, err)
@@ -385,6 +659,28 @@ func (s *Session) ExecuteAction(param *ActionParam) {
 
 	}
 
+	//循环节点执行成功后判断是否继续循环，继续时本次不执行后续路径
+	var loop *ActionParam
+	if res == RESULT_SUCCESS && run {
+		loop, err = s.nextActionLoop(param)
+		if err != nil {
+			res = RESULT_FAILURE
+			actionState.Error = err.Error()
+			s.AddLog_action_error(actionState.ActionName, actionState.ActionTitle, err.Error())
+		}
+	}
+
+	//排他路由，执行成功并且循环结束后选择要走的路径
+	if res == RESULT_SUCCESS && run && loop == nil && s.Runner != nil && s.GetFlow().GetAction(param.ActionId).IsExclusive() {
+		chosen, err = s.routeExclusive(param, actionState)
+		if err != nil {
+			res = RESULT_FAILURE
+			actionState.Error = err.Error()
+			s.Runner.OnActionFailure(s, param, actionState, err)
+			s.AddLog_action_error(actionState.ActionName, actionState.ActionTitle, err.Error())
+		}
+	}
+
 	// 记录状态
 	actionState.State = int(res)
 	// 记录是否失败标记
@@ -393,7 +689,7 @@ func (s *Session) ExecuteAction(param *ActionParam) {
 	}
 
 	// 只有执行成功才能进行后续节点
-	if res == RESULT_SUCCESS {
+	if res == RESULT_SUCCESS && loop == nil {
 
 		flow := s.GetFlow()
 
@@ -407,19 +703,52 @@ func (s *Session) ExecuteAction(param *ActionParam) {
 				if link.Active == "false" {
 					continue
 				}
-				//如果有特别指定后续节点，就进行判断,如果不在指定的后续节点当中就不执行。
+				//执行成功时错误路径为死路径
+				if link.IsErrorLink() {
+					s.skipLink(param, link)
+					continue
+				}
+				//如果有特别指定后续节点，就进行判断,如果不在指定的后续节点当中就不执行，下游有汇聚节点时传递跳过标记。
 				if nextActionIds != nil && len(nextActionIds) > 0 {
 					if arrayIndexOf(nextActionIds, link.TargetId) < 0 {
+						s.skipLink(param, link)
 						continue
 					}
 				}
 
-				linkParam := &LinkParam{RuntimeId: param.RuntimeId, SourceId: link.SourceId, TargetId: link.TargetId}
+				linkParam := s.createLinkParam(param, link)
+				//排他路由只走选中的路径
+				if chosen != nil {
+					if link != chosen {
+						s.skipLink(param, link)
+						continue
+					}
+					linkParam.IsChosen = 1
+				}
 				s.ToLink(linkParam)
 			}
 		}
 	}
 
+	// 失败的节点，有错误路径时按照错误路径继续执行，否则后续路径为死路径
+	if res == RESULT_FAILURE {
+		if fatal {
+			s.failGroup(param, actionState)
+			atomic.AddInt32(&s.failures, 1)
+			s.skipNextLinks(param)
+		} else if s.routeError(param, actionState) {
+			actionState.IsHandled = 1
+		} else {
+			//组内的节点失败时组失败，组有错误路径时由组处理
+			if s.failGroup(param, actionState) {
+				actionState.IsHandled = 1
+			} else {
+				atomic.AddInt32(&s.failures, 1)
+			}
+			s.skipNextLinks(param)
+		}
+	}
+
 	// 成功或者失败都记录
 	if res == RESULT_SUCCESS || res == RESULT_FAILURE {
 		//删除正在执行的节点记录
@@ -431,74 +760,184 @@ func (s *Session) ExecuteAction(param *ActionParam) {
 		s.Operation.AddActionState(actionState)
 	}
 
+	//记录本次执行后再开始下一次循环
+	if loop != nil {
+		s.ToAction(loop)
+	}
+
+	//没有执行，释放只执行一次的占用
+	if res == RESULT_REJECT {
+		s.releaseOnce(param.ActionId)
+
+		//被汇聚节点取消时按照死路径处理；否则保留在待执行列表中，下次执行时重试
+		if s.isActionSkipped(param) {
+			s.skipAction(param, actionState, "汇聚节点已经执行，取消并跳过")
+			s.skipNextLinks(param)
+		} else {
+			s.waitGroup(param.GroupId)
+		}
+	}
+
 }
 
-// 连接线处理
-func (s *Session) runProcessLink(sourceId, targetId string, w *sync.WaitGroup) {
-	c := s.getLinkChan(sourceId, targetId)
-	if c == nil {
-		c = make(chan *LinkParam, chan_len)
-		s.setLinkChan(sourceId, targetId, c)
+// 节点失败后按照错误路径执行，其他路径为死路径，没有错误路径时返回false
+func (s *Session) routeError(param *ActionParam, actionState *ActionStateModel) bool {
+	links := make([]*LinkModel, 0)
+	for _, link := range s.GetFlow().GetLinkBySourceId(param.ActionId) {
+		if link.Active != "false" && link.IsErrorLink() {
+			links = append(links, link)
+		}
+	}
+	if len(links) == 0 {
+		return false
 	}
-	w.Done()
 
-EVENT_LOOP:
-	for {
-		select {
-		// 消息通道中有消息则执行，否则堵塞
-		case param := <-c:
-			if param.Cmd == 1 {
-				break EVENT_LOOP
-			}
+	actionError := &ActionErrorModel{
+		ActionId:  param.ActionId,
+		Runner:    actionState.ActionName,
+		Message:   actionState.Error,
+		Attempt:   1,
+		IsTimeout: actionState.IsTimeout,
+	}
+	if len(actionState.Attempts) > 0 {
+		actionError.Attempt = len(actionState.Attempts)
+	}
 
-			s.ExecuteLink(param)
+	for _, link := range s.GetFlow().GetLinkBySourceId(param.ActionId) {
+		if link.Active == "false" {
+			continue
+		}
+		if !link.IsErrorLink() {
+			s.skipLink(param, link)
+			continue
 		}
+		linkParam := s.createLinkParam(param, link)
+		linkParam.Error = actionError
+		s.ToLink(linkParam)
 	}
 
+	s.AddLog_action_info(actionState.ActionName, actionState.ActionTitle, "执行失败，按照错误路径继续执行")
+	return true
 }
 
-func (s *Session) stopProcessLink(sourceId, targetId string) {
-	c := s.getLinkChan(sourceId, targetId)
-	if c == nil {
+// 向节点的后续路径传递跳过标记
+func (s *Session) skipNextLinks(param *ActionParam) {
+	for _, link := range s.GetFlow().GetLinkBySourceId(param.ActionId) {
+		if link.Active == "false" {
+			continue
+		}
+		s.skipLink(param, link)
+	}
+}
+
+// 向连接线传递跳过标记，只有下游有汇聚节点时才需要传递
+func (s *Session) skipLink(param *ActionParam, link *LinkModel) {
+	if !s.reachCollectAction(link.TargetId) {
 		return
 	}
+	linkParam := s.createLinkParam(param, link)
+	linkParam.IsSkip = 1
+	s.ToLink(linkParam)
+}
+
+// 创建节点后续连接线的执行参数，组和迭代信息沿路径传递
+func (s *Session) createLinkParam(param *ActionParam, link *LinkModel) *LinkParam {
+	return &LinkParam{RuntimeId: param.RuntimeId, SourceId: link.SourceId, TargetId: link.TargetId, GroupId: param.GroupId, Iteration: param.Iteration}
+}
+
+// 占用只执行一次的节点，返回false表示已经执行过
+func (s *Session) acquireOnce(actionId string) bool {
+	action := s.GetFlow().GetAction(actionId)
+	if action == nil || strings.ToLower(action.Once) != "true" {
+		return true
+	}
+
+	s.onceLock.Lock()
+	defer s.onceLock.Unlock()
+
+	if s.onceActions[actionId] {
+		return false
+	}
+	//恢复执行的时候，根据已有的节点状态判断
+	for _, st := range s.Operation.GetActionStates(actionId) {
+		if st.IsSkip == 0 && st.State != int(RESULT_REJECT) {
+			return false
+		}
+	}
+
+	s.onceActions[actionId] = true
+	return true
+}
+
+// 释放只执行一次的节点占用
+func (s *Session) releaseOnce(actionId string) {
+	s.onceLock.Lock()
+	defer s.onceLock.Unlock()
+
+	delete(s.onceActions, actionId)
+}
+
+// 跳过节点，记录跳过状态
+func (s *Session) skipAction(param *ActionParam, actionState *ActionStateModel, reason string) {
+	s.Operation.DelRunningAction(param)
 
-	param := &LinkParam{Cmd: 1}
+	actionState.IsSkip = 1
+	actionState.State = int(RESULT_REJECT)
+	actionState.EndTime = time.Now()
+	actionState.Timeused = actionState.EndTime.Sub(actionState.BeginTime).Milliseconds()
+	s.Operation.AddActionState(actionState)
 
-	c <- param
+	s.AddLog_action_info(actionState.ActionName, actionState.ActionTitle, reason)
 }
 
 func (s *Session) ToLink(param *LinkParam) {
+	//离开组的路径，等待组执行结束后再执行
+	if s.exitGroup(param) {
+		return
+	}
+	s.addGroupPending(param.GroupId, param.Iteration)
+
 	if s.Router != nil {
 		//准备执行的路径
 		s.Operation.AddRunningLink(param)
-		//如果停止
-		if s.Operation.GetCmd() == CMD_STOP {
+
+		s.cmdLock.Lock()
+		switch s.Operation.GetCmd() {
+		case CMD_STOP: //如果停止
+			s.cmdLock.Unlock()
+			return
+		case CMD_PAUSE: //如果暂停
+			s.pausedLinks = append(s.pausedLinks, param)
+			s.cmdLock.Unlock()
 			return
 		}
-
 		s.Operation.WaitAdd(1)
+		s.cmdLock.Unlock()
+
 		s.Router.RouteLink(s, param)
 	}
 }
 
+// 将连接线提交到工作协程池执行
 func (s *Session) PushLink(param *LinkParam) bool {
 
-	c := s.getLinkChan(param.SourceId, param.TargetId)
-	if c == nil {
+	ok := s.scheduler.submit(func() {
+		s.ExecuteLink(param)
+	})
+	if !ok {
 		s.Operation.WaitDone()
 		return false
 	}
-
-	c <- param
 	return true
 }
 
 func (s *Session) ExecuteLink(param *LinkParam) {
 	defer s.Operation.WaitDone()
+	defer s.leaveGroup(param.GroupId)
 	var err error
 	var res Result = RESULT_SUCCESS
 	linkState := s.createLinkState(param.SourceId, param.TargetId)
+	linkState.Iteration = param.Iteration
 
 	defer func() {
 		s.Runner.OnLinkExecuted(s, param, linkState, res, err)
@@ -507,8 +946,15 @@ func (s *Session) ExecuteLink(param *LinkParam) {
 	sourceAction := s.GetFlow().GetAction(param.SourceId)
 	targetAction := s.GetFlow().GetAction(param.TargetId)
 
-	if s.Runner != nil {
-		res, err = s.Runner.ExecuteLink(s, param, linkState)
+	//死路径上的连接线不执行，直接到达目标节点
+	if param.IsSkip == 1 {
+		res = RESULT_REJECT
+		linkState.IsSkip = 1
+	} else if param.IsChosen == 1 {
+		//排他路由已经判断过滤条件
+		res = RESULT_SUCCESS
+	} else if s.Runner != nil {
+		res, err = executeFlowRunnerLink(s.Ctx, s.Runner, s, param, linkState)
 		if res == RESULT_FAILURE || err != nil {
 			if err == nil {
 				err = errors.New("连接线返回错误")
@@ -524,52 +970,24 @@ func (s *Session) ExecuteLink(param *LinkParam) {
 	linkState.State = int(res)
 	if res == RESULT_FAILURE {
 		linkState.IsError = 1
+		atomic.AddInt32(&s.failures, 1)
 	}
 
-	if res == RESULT_SUCCESS {
-
-		canNext := true
-		flow := s.GetFlow()
-		nextAction := flow.GetAction(param.TargetId)
-
-		//如果是汇聚模式，需要等待所有连线都执行通过
-		if strings.ToLower(nextAction.Collect) == "true" {
-			fromLinks := flow.GetLinkByTargetId(param.TargetId)
-			if fromLinks != nil && len(fromLinks) > 1 {
-
-				activeLinks := make([]*LinkModel, 0)
-				for _, link := range fromLinks {
-					if link.Active != "false" {
-						activeLinks = append(activeLinks, link)
-					}
-				}
+	//拒绝执行的连接线，下游有汇聚节点时按照死路径处理，否则保留在待执行列表中，下次执行时重试
+	if res == RESULT_REJECT && linkState.IsSkip == 0 && s.reachCollectAction(param.TargetId) {
+		linkState.IsSkip = 1
+	}
 
-				passCount := 0
-				for _, link := range activeLinks {
-					st := s.Operation.GetLastLinkState(link.SourceId, link.TargetId)
-					if st != nil && st.State == int(RESULT_SUCCESS) {
-						passCount = passCount + 1
-					}
-				}
-				if passCount+1 < len(activeLinks) {
-					canNext = false
-				}
-			}
-		}
+	if res == RESULT_SUCCESS || res == RESULT_FAILURE || linkState.IsSkip == 1 {
+		linkState.EndTime = time.Now()
+		linkState.Timeused = linkState.EndTime.Sub(linkState.BeginTime).Milliseconds()
 
-		if canNext {
-			actionParam := &ActionParam{RuntimeId: param.RuntimeId, ActionId: param.TargetId, PreActionId: param.SourceId}
+		actionParam := s.arriveAction(param, linkState)
+		if actionParam != nil {
 			s.ToAction(actionParam)
 		}
 
-	}
-
-	if res == RESULT_SUCCESS || res == RESULT_FAILURE {
 		s.Operation.DelRunningLink(param) //移除待办路径中已经执行的路径
-		linkState.EndTime = time.Now()
-		linkState.Timeused = linkState.EndTime.Sub(linkState.BeginTime).Milliseconds()
-
-		s.Operation.AddLinkState(linkState)
 	}
 
 }
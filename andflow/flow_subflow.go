@@ -0,0 +1,172 @@
+package andflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	//子流程执行器名称
+	SUBFLOW_RUNNER = "subflow"
+
+	//子流程执行方式
+	SUBFLOW_MODE_SYNC  = "sync"  //等待子流程执行完成，默认
+	SUBFLOW_MODE_ASYNC = "async" //启动子流程后继续执行，不等待结果
+)
+
+var ErrSubflowDepth = errors.New("超过子流程最多嵌套层数")
+
+var subflowMaxDepth = 10 //默认子流程最多嵌套层数
+
+func init() {
+	RegistActionRunner(SUBFLOW_RUNNER, &SubflowActionRunner{})
+}
+
+// 设置子流程最多嵌套层数，防止流程直接或者间接调用自身时无限递归
+func SetSubflowMaxDepth(depth int) {
+	if depth > 0 {
+		subflowMaxDepth = depth
+	}
+}
+
+func GetSubflowMaxDepth() int {
+	return subflowMaxDepth
+}
+
+// 子流程执行器，根据节点参数flow_code和flow_version从流程仓库获取流程并调用。
+// input为传入子流程的参数，格式为"子流程参数=父流程参数"，多个用逗号分隔，为空时传入所有参数；
+// output为子流程结果写入节点数据的映射，格式为"节点数据=子流程参数"，为空时写入子流程所有参数
+type SubflowActionRunner struct {
+}
+
+func (r *SubflowActionRunner) Properties() []Prop {
+	return []Prop{
+		{Name: "flow_code", Label: "子流程编码", Required: true},
+		{Name: "flow_version", Label: "子流程版本，为空时使用最新版本", Default: FLOW_VERSION_LATEST},
+		{Name: "mode", Label: "执行方式：sync，async", Default: SUBFLOW_MODE_SYNC},
+		{Name: "input", Label: "传入参数，子流程参数=父流程参数"},
+		{Name: "output", Label: "返回数据，节点数据=子流程参数"},
+		{Name: "flow_timeout", Label: "子流程执行时效，毫秒数或者时长格式，为空时使用子流程定义的执行时效"},
+	}
+}
+
+func (r *SubflowActionRunner) Execute(s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	return r.ExecuteContext(s.GetActionContext(param), s, param, state)
+}
+
+func (r *SubflowActionRunner) ExecuteContext(ctx context.Context, s *Session, param *ActionParam, state *ActionStateModel) (Result, error) {
+	action := s.GetFlow().GetAction(param.ActionId)
+
+	code := action.GetParam("flow_code")
+	flow, err := GetFlowRepository().Get(code, action.GetParam("flow_version"))
+	if err != nil {
+		return RESULT_FAILURE, err
+	}
+
+	input := make(map[string]interface{})
+	mapping := parseSubflowMapping(action.GetParam("input"))
+	if len(mapping) == 0 {
+		input = s.GetParamMap()
+	}
+	for name, parentName := range mapping {
+		input[name] = s.GetParam(parentName)
+	}
+
+	parent := s.GetRuntime()
+	if parent.Depth >= GetSubflowMaxDepth() {
+		return RESULT_FAILURE, fmt.Errorf("%w：%d", ErrSubflowDepth, GetSubflowMaxDepth())
+	}
+	runtime := CreateRuntime(flow, input)
+	runtime.ParentId = s.Id
+	runtime.ParentAction = param.ActionId
+	runtime.UserId = parent.UserId
+	runtime.GroupId = parent.GroupId
+	runtime.Depth = parent.Depth + 1
+	state.SetData("subflow_runtime_id", runtime.Id)
+
+	timeout := int64(0)
+	if d, err := ParseDuration(action.GetParam("flow_timeout")); err == nil {
+		timeout = d.Milliseconds()
+	}
+	s.AddLog_action_info(action.Name, action.Title, fmt.Sprintf("执行子流程：%s@%s，%s", code, flow.Version, runtime.Id))
+
+	if strings.ToLower(action.GetParam("mode")) == SUBFLOW_MODE_ASYNC {
+		s.executeSubflowAsync(runtime, timeout)
+		return RESULT_SUCCESS, nil
+	}
+
+	runtime = s.executeSubflow(ctx, runtime, timeout)
+
+	output := parseSubflowMapping(action.GetParam("output"))
+	if len(output) == 0 {
+		for name, val := range runtime.GetParamMap() {
+			state.SetData(name, val)
+		}
+	}
+	for name, childName := range output {
+		state.SetData(name, runtime.GetParam(childName))
+	}
+
+	if runtime.FlowState != FLOW_STATE_COMPLETED {
+		return RESULT_FAILURE, fmt.Errorf("子流程执行失败：%s，%s", code, GetFlowStateName(runtime.FlowState))
+	}
+	return RESULT_SUCCESS, nil
+}
+
+// 执行子流程，使用父流程的路由、执行器以及运行时的存储和保存策略
+func (s *Session) executeSubflow(ctx context.Context, runtime *RuntimeModel, timeout int64) *RuntimeModel {
+	operation := &CommonRuntimeOperation{}
+	operation.Init(runtime)
+	if parent, ok := s.Operation.(*CommonRuntimeOperation); ok {
+		operation.SetStore(parent.Store)
+		operation.SetSavePolicy(parent.SavePolicy)
+	}
+
+	ExecuteContext(ctx, operation, s.Router, s.Runner, timeout)
+	return operation.GetRuntime()
+}
+
+// 不等待子流程执行完成，父流程超时或者取消的时候取消子流程，正常结束时子流程继续执行
+func (s *Session) executeSubflowAsync(runtime *RuntimeModel, timeout int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		s.executeSubflow(ctx, runtime, timeout)
+	}()
+
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-s.watchDone:
+		}
+		switch s.Operation.GetState() {
+		case FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL:
+			cancel()
+		}
+	}()
+}
+
+// 解析参数映射，格式为"a=b,c=d"，只写名称时两边相同
+func parseSubflowMapping(str string) map[string]string {
+	mapping := make(map[string]string)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) == 1 {
+			mapping[name] = name
+		} else {
+			mapping[name] = strings.TrimSpace(kv[1])
+		}
+	}
+	return mapping
+}
@@ -0,0 +1,188 @@
+package andflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	//重试退避方式
+	BACKOFF_FIXED       = "fixed"       //固定间隔
+	BACKOFF_EXPONENTIAL = "exponential" //指数增长
+
+	//可以重试的超时错误，设置在RetryOn中
+	RETRY_ON_TIMEOUT = "timeout"
+)
+
+// 重试策略
+type RetryModel struct {
+	MaxAttempts int      `bson:"max_attempts" json:"max_attempts"` //最多执行次数，包含第一次执行
+	Backoff     string   `bson:"backoff" json:"backoff"`           //退避方式：fixed，exponential
+	Interval    string   `bson:"interval" json:"interval"`         //重试间隔，毫秒数或者时长格式
+	MaxInterval string   `bson:"max_interval" json:"max_interval"` //最大重试间隔，指数增长时使用
+	Jitter      float64  `bson:"jitter" json:"jitter"`             //随机抖动比例，0~1
+	RetryOn     []string `bson:"retry_on" json:"retry_on"`         //可以重试的错误关键词，为空表示所有错误都重试
+}
+
+func (r *RetryModel) GetMaxAttempts() int {
+	if r.MaxAttempts < 1 {
+		return 1
+	}
+	return r.MaxAttempts
+}
+
+// 获取第attempt次执行失败后的等待时间
+func (r *RetryModel) GetDelay(attempt int) time.Duration {
+	delay := r.getBaseDelay(attempt)
+	if r.Jitter > 0 && delay > 0 {
+		delay = time.Duration(float64(delay) * (1 + r.getJitter()*(rand.Float64()*2-1)))
+	}
+	return delay
+}
+
+// 获取第attempt次执行失败后最长的等待时间
+func (r *RetryModel) getMaxDelay(attempt int) time.Duration {
+	return time.Duration(float64(r.getBaseDelay(attempt)) * (1 + r.getJitter()))
+}
+
+func (r *RetryModel) getJitter() float64 {
+	if r.Jitter < 0 {
+		return 0
+	}
+	if r.Jitter > 1 {
+		return 1
+	}
+	return r.Jitter
+}
+
+// 获取第attempt次执行失败后不包含抖动的等待时间
+func (r *RetryModel) getBaseDelay(attempt int) time.Duration {
+	interval, err := ParseDuration(r.Interval)
+	if err != nil || interval < 0 {
+		interval = 0
+	}
+
+	delay := interval
+	if strings.ToLower(r.Backoff) == BACKOFF_EXPONENTIAL {
+		for i := 1; i < attempt; i++ {
+			delay = delay * 2
+		}
+	}
+
+	maxInterval, err := ParseDuration(r.MaxInterval)
+	if err == nil && maxInterval > 0 && delay > maxInterval {
+		delay = maxInterval
+	}
+
+	return delay
+}
+
+// 判断错误是否可以重试，RetryOn包含timeout时尝试超时可以重试
+func (r *RetryModel) IsRetryable(err error) bool {
+	if len(r.RetryOn) == 0 {
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, key := range r.RetryOn {
+		if strings.ToLower(key) == RETRY_ON_TIMEOUT && isTimeoutError(err) {
+			return true
+		}
+		if len(key) > 0 && strings.Contains(msg, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为超时错误，包括脚本超时中断返回的错误
+func isTimeoutError(err error) bool {
+	return errors.Is(err, ErrActionTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// 设置了多次尝试的重试策略时，执行时效用于每次尝试
+func (m *ActionModel) IsRetryAttemptTimeout() bool {
+	return m.Retry != nil && m.Retry.GetMaxAttempts() > 1
+}
+
+// 按照重试策略执行的总时效（毫秒），为每次尝试的时效加上最长的重试间隔，没有设置执行时效返回0
+func (m *ActionModel) getRetryTimeout() int64 {
+	timeout := m.GetTimeout()
+	if timeout <= 0 || !m.IsRetryAttemptTimeout() {
+		return timeout
+	}
+	maxAttempts := m.Retry.GetMaxAttempts()
+	total := timeout * int64(maxAttempts)
+	for i := 1; i < maxAttempts; i++ {
+		total += m.Retry.getMaxDelay(i).Milliseconds()
+	}
+	return total
+}
+
+// 按照节点的重试策略执行节点执行器，会话或者节点上下文结束后不再重试
+func executeActionRunner(ctx context.Context, s *Session, runner ActionRunner, param *ActionParam, state *ActionStateModel) (Result, error) {
+	contextRunner := ToContextActionRunner(runner)
+
+	action := s.GetFlow().GetAction(param.ActionId)
+	retry := action.Retry
+	if retry == nil {
+		return contextRunner.ExecuteContext(ctx, s, param, state)
+	}
+
+	maxAttempts := retry.GetMaxAttempts()
+	timeout := int64(0)
+	if action.IsRetryAttemptTimeout() {
+		timeout = action.GetTimeout()
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptState := &ActionAttemptModel{Attempt: attempt, BeginTime: time.Now()}
+
+		attemptCtx, cancel := s.createAttemptContext(ctx, param, timeout)
+		res, err := contextRunner.ExecuteContext(attemptCtx, s, param, state)
+		//尝试超时，会话和节点上下文没有结束
+		if (err != nil || res == RESULT_FAILURE) && attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			res, err = RESULT_FAILURE, ErrActionTimeout
+		}
+		cancel()
+
+		attemptState.EndTime = time.Now()
+		attemptState.Timeused = attemptState.EndTime.Sub(attemptState.BeginTime).Milliseconds()
+		state.Attempts = append(state.Attempts, attemptState)
+
+		if err == nil && res != RESULT_FAILURE {
+			return res, nil
+		}
+
+		failure := err
+		if failure == nil {
+			failure = errors.New("节点执行失败")
+		}
+		attemptState.Error = failure.Error()
+
+		if attempt >= maxAttempts || ctx.Err() != nil || !retry.IsRetryable(failure) {
+			return res, err
+		}
+
+		delay := retry.GetDelay(attempt)
+		s.AddLog_action_info(action.Name, action.Title, fmt.Sprintf("第%d次执行失败，%v后重试：%v", attempt, delay, failure))
+
+		//清除失败的尝试设置的后续节点和结果数据
+		state.NextActionIds = nil
+		state.Data = nil
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		case <-timer.C:
+		}
+	}
+}
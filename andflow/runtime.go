@@ -7,23 +7,47 @@ import (
 
 // 节点执行参数
 type ActionParam struct {
-	RuntimeId   string `json:"runtime_id"`
-	ActionId    string `json:"action_id"`     //当前节点ID
-	PreActionId string `json:"pre_action_id"` //上一个节点ID
+	RuntimeId    string            `json:"runtime_id"`
+	ActionId     string            `json:"action_id"`     //当前节点ID
+	PreActionId  string            `json:"pre_action_id"` //上一个节点ID
+	IsSkip       int               `json:"is_skip"`       //死路径上传递的跳过标记，节点不执行
+	CollectIds   []string          `json:"collect_ids"`   //汇聚节点执行时已经通过的连入路径源节点ID
+	Error        *ActionErrorModel `json:"error"`         //通过错误路径到达时，上一个节点的错误信息
+	IsCompensate int               `json:"is_compensate"` //是否为补偿执行
+	GroupId      string            `json:"group_id"`      //所在的组，组内执行时使用
+	Iteration    int               `json:"iteration"`     //组或者循环的第几次迭代，从1开始，0表示不在迭代中
+	LoopIndex    int               `json:"loop_index"`    //循环节点的第几次执行，从1开始，0表示不是循环节点
 	// Timeout     int64  `json:"timeout"`
 
 	Cmd int `json:"cmd"` //指令  1:停止,2.3.4..
 }
 
+// 是否为同一个待执行的节点，同一个节点在不同的组、迭代、循环次数中或者作为跳过标记时分别记录
+func (p *ActionParam) isSameRunning(o *ActionParam) bool {
+	return p.ActionId == o.ActionId && p.PreActionId == o.PreActionId && p.GroupId == o.GroupId &&
+		p.Iteration == o.Iteration && p.LoopIndex == o.LoopIndex && p.IsSkip == o.IsSkip
+}
+
 // 连接线执行参数
 type LinkParam struct {
-	RuntimeId string `json:"runtime_id"`
-	SourceId  string `json:"source_id"` //源ID
-	TargetId  string `json:"target_id"` //目的ID
+	RuntimeId string            `json:"runtime_id"`
+	SourceId  string            `json:"source_id"` //源ID
+	TargetId  string            `json:"target_id"` //目的ID
+	IsSkip    int               `json:"is_skip"`   //死路径上传递的跳过标记，连接线不执行
+	IsChosen  int               `json:"is_chosen"` //排他路由已经选中的连接线，不再执行过滤
+	Error     *ActionErrorModel `json:"error"`     //错误路径上传递的源节点错误信息
+	GroupId   string            `json:"group_id"`  //所在的组，组内执行时使用
+	Iteration int               `json:"iteration"` //组或者循环的第几次迭代
 	// Timeout   int64  `json:"timeout"`
 	Cmd int `json:"cmd"` //指令  1:停止,2.3.4..
 }
 
+// 是否为同一个待执行的连接线，同一个连接线在不同的组、迭代中或者作为跳过标记时分别记录
+func (p *LinkParam) isSameRunning(o *LinkParam) bool {
+	return p.SourceId == o.SourceId && p.TargetId == o.TargetId && p.GroupId == o.GroupId &&
+		p.Iteration == o.Iteration && p.IsSkip == o.IsSkip
+}
+
 // 节点内容
 type ActionContentModel struct {
 	ActionId    string `bson:"action_id" json:"action_id"`       //节点ID
@@ -39,20 +63,59 @@ type ActionDataModel struct {
 
 // 节点状态
 type ActionStateModel struct {
-	ActionId      string              `bson:"action_id" json:"action_id"`             //节点ID
-	ActionName    string              `bson:"action_name" json:"action_name"`         //节点名称
-	ActionTitle   string              `bson:"action_title" json:"action_title"`       //节点标题
-	ActionDes     string              `bson:"action_des" json:"action_des"`           //节点描述
-	ActionIcon    string              `bson:"action_icon" json:"action_icon"`         //节点图标
-	PreActionId   string              `bson:"pre_action_id" json:"pre_action_id"`     //上一个节点ID
-	NextActionIds []string            `bson:"next_action_ids" json:"next_action_ids"` //下一步要执行的ID列表
-	IsError       int                 `bson:"is_error" json:"is_error"`               //是否异常
-	State         int                 `bson:"state" json:"state"`                     //状态：1，完成并继续往下，0 未来执行， -1完成并终止
-	Data          []*ActionDataModel  `bson:"data" json:"data"`                       //执行结果
-	Content       *ActionContentModel `bson:"content" json:"content"`                 //界面显示的内容
-	BeginTime     time.Time           `bson:"begin_time" json:"begin_time"`           //开始时间
-	EndTime       time.Time           `bson:"end_time" json:"end_time"`               //完成时间
-	Timeused      int64               `bson:"timeused" json:"timeused"`               //耗时
+	ActionId      string                `bson:"action_id" json:"action_id"`             //节点ID
+	ActionName    string                `bson:"action_name" json:"action_name"`         //节点名称
+	ActionTitle   string                `bson:"action_title" json:"action_title"`       //节点标题
+	ActionDes     string                `bson:"action_des" json:"action_des"`           //节点描述
+	ActionIcon    string                `bson:"action_icon" json:"action_icon"`         //节点图标
+	PreActionId   string                `bson:"pre_action_id" json:"pre_action_id"`     //上一个节点ID
+	NextActionIds []string              `bson:"next_action_ids" json:"next_action_ids"` //下一步要执行的ID列表
+	IsError       int                   `bson:"is_error" json:"is_error"`               //是否异常
+	IsSkip        int                   `bson:"is_skip" json:"is_skip"`                 //是否跳过
+	IsTimeout     int                   `bson:"is_timeout" json:"is_timeout"`           //是否超时
+	IsHandled     int                   `bson:"is_handled" json:"is_handled"`           //错误是否已经由错误路径处理，处理过的错误不计入运行时异常
+	IsCompensate  int                   `bson:"is_compensate" json:"is_compensate"`     //是否为补偿执行记录
+	GroupId       string                `bson:"group_id" json:"group_id"`               //执行时所在的组
+	Iteration     int                   `bson:"iteration" json:"iteration"`             //执行时是组或者循环的第几次迭代，同一次迭代的状态属于同一组
+	LoopIndex     int                   `bson:"loop_index" json:"loop_index"`           //循环节点的第几次执行
+	Error         string                `bson:"error" json:"error"`                     //错误信息
+	Attempts      []*ActionAttemptModel `bson:"attempts" json:"attempts"`               //按照重试策略执行的每次尝试
+	CollectIds    []string              `bson:"collect_ids" json:"collect_ids"`         //汇聚节点执行时已经通过的连入路径源节点ID
+	Routes        []*ActionRouteModel   `bson:"routes" json:"routes"`                   //排他路由的判断记录
+	State         int                   `bson:"state" json:"state"`                     //状态：1，完成并继续往下，0 未来执行， -1完成并终止
+	Data          []*ActionDataModel    `bson:"data" json:"data"`                       //执行结果
+	Content       *ActionContentModel   `bson:"content" json:"content"`                 //界面显示的内容
+	BeginTime     time.Time             `bson:"begin_time" json:"begin_time"`           //开始时间
+	EndTime       time.Time             `bson:"end_time" json:"end_time"`               //完成时间
+	Timeused      int64                 `bson:"timeused" json:"timeused"`               //耗时
+}
+
+// 节点执行尝试记录
+type ActionAttemptModel struct {
+	Attempt   int       `bson:"attempt" json:"attempt"`       //第几次尝试
+	Error     string    `bson:"error" json:"error"`           //错误信息
+	BeginTime time.Time `bson:"begin_time" json:"begin_time"` //开始时间
+	EndTime   time.Time `bson:"end_time" json:"end_time"`     //完成时间
+	Timeused  int64     `bson:"timeused" json:"timeused"`     //耗时
+}
+
+// 节点错误信息，通过错误路径传递给后续节点
+type ActionErrorModel struct {
+	ActionId  string `bson:"action_id" json:"action_id"`   //出错的节点ID
+	Runner    string `bson:"runner" json:"runner"`         //节点执行器名称
+	Message   string `bson:"message" json:"message"`       //错误信息
+	Attempt   int    `bson:"attempt" json:"attempt"`       //第几次尝试时失败
+	IsTimeout int    `bson:"is_timeout" json:"is_timeout"` //是否超时
+}
+
+// 排他路由判断记录
+type ActionRouteModel struct {
+	TargetId  string `bson:"target_id" json:"target_id"`   //目的ID
+	Order     int    `bson:"order" json:"order"`           //判断顺序
+	IsDefault int    `bson:"is_default" json:"is_default"` //是否为默认路径
+	State     int    `bson:"state" json:"state"`           //过滤结果：1 满足，0 不满足，-1 异常
+	IsChosen  int    `bson:"is_chosen" json:"is_chosen"`   //是否选中
+	Error     string `bson:"error" json:"error"`           //过滤异常信息
 }
 
 // 连接线状态
@@ -60,6 +123,8 @@ type LinkStateModel struct {
 	SourceActionId string    `bson:"source_action_id" json:"source_action_id"` //源ID
 	TargetActionId string    `bson:"target_action_id" json:"target_action_id"` //目的ID
 	IsError        int       `bson:"is_error" json:"is_error"`                 //是否异常
+	IsSkip         int       `bson:"is_skip" json:"is_skip"`                   //是否为死路径，跳过
+	Iteration      int       `bson:"iteration" json:"iteration"`               //执行时是组或者循环的第几次迭代
 	State          int       `bson:"state" json:"state"`                       //状态
 	BeginTime      time.Time `bson:"begin_time" json:"begin_time"`             //开始时间
 	EndTime        time.Time `bson:"end_time" json:"end_time"`                 //完成时间
@@ -95,10 +160,13 @@ type RuntimeParamModel struct {
 type RuntimeModel struct {
 	Id             string               `bson:"_id" json:"id"`                          //ID
 	Flow           *FlowModel           `bson:"flow" json:"flow"`                       //流程
+	FlowCode       string               `bson:"flow_code" json:"flow_code"`             //流程编码
+	FlowVersion    string               `bson:"flow_version" json:"flow_version"`       //开始执行时使用的流程版本，恢复执行时使用相同的版本
 	Des            string               `bson:"des" json:"des"`                         //描述
 	BeginTime      time.Time            `bson:"begin_time" json:"begin_time"`           //开始时间
 	EndTime        time.Time            `bson:"end_time" json:"end_time"`               //完成时间
 	Timeused       int64                `bson:"timeused" json:"timeused"`               //耗时（毫秒)
+	Timeout        int64                `bson:"timeout" json:"timeout"`                 //执行时效（毫秒），0表示不限制
 	IsRunning      int                  `bson:"is_running" json:"is_running"`           //是否正在运行
 	IsError        int                  `bson:"is_error" json:"is_error"`               //是否异常
 	RunningLinks   []*LinkParam         `bson:"running_links" json:"running_links"`     //待执行连接线
@@ -114,6 +182,9 @@ type RuntimeModel struct {
 	UserId         string               `bson:"user_id" json:"user_id"`                 //用户ID
 	RequestId      string               `bson:"request_id" json:"request_id"`           //请求执行ID
 	GroupId        string               `bson:"group_id" json:"group_id"`               //所属部门、组
+	ParentId       string               `bson:"parent_id" json:"parent_id"`             //父流程运行时ID，子流程使用
+	ParentAction   string               `bson:"parent_action" json:"parent_action"`     //父流程中调用子流程的节点ID
+	Depth          int                  `bson:"depth" json:"depth"`                     //子流程的嵌套层数，顶层流程为0
 }
 
 func (a *ActionStateModel) SetData(name string, value interface{}) {
@@ -190,6 +261,41 @@ func (a *RuntimeModel) GetActionState(actionId string, preActionId string) *Acti
 	}
 	return nil
 }
+func (a *RuntimeModel) GetActionStates(actionId string) []*ActionStateModel {
+	res := make([]*ActionStateModel, 0)
+	if a.ActionStates == nil {
+		return res
+	}
+	for _, state := range a.ActionStates {
+		if state.ActionId == actionId {
+			res = append(res, state)
+		}
+	}
+	return res
+}
+
+// 按照迭代分组获取执行记录，id为组ID时按照组的迭代分组，为循环节点ID时按照节点的执行次数分组，
+// 第i个分组为第i+1次迭代的执行记录
+func (a *RuntimeModel) GetIterationStates(id string) [][]*ActionStateModel {
+	res := make([][]*ActionStateModel, 0)
+	for _, state := range a.ActionStates {
+		index := 0
+		if state.GroupId == id {
+			index = state.Iteration
+		} else if state.ActionId == id {
+			index = state.LoopIndex
+		}
+		if index <= 0 || state.IsCompensate == 1 {
+			continue
+		}
+		for len(res) < index {
+			res = append(res, make([]*ActionStateModel, 0))
+		}
+		res[index-1] = append(res[index-1], state)
+	}
+	return res
+}
+
 func (a *RuntimeModel) GetLastActionState(actionId string) *ActionStateModel {
 	if a.ActionStates == nil {
 		return nil
@@ -356,9 +462,42 @@ func (a *RuntimeModel) GetActionDataMap(actionId string) map[string]interface{}
 	}
 	return res
 }
-func (a *RuntimeModel) AddLog(tp string, tag string, name string, title string, content string) {
+func (a *RuntimeModel) AddLog(tp string, tag string, name string, title string, content string) *LogModel {
 	log := &LogModel{Tp: tp, Tag: tag, Name: name, Title: title, Content: content, Time: time.Now()}
 	a.Logs = append(a.Logs, log)
+	return log
+}
+
+// 开始执行
+func (r *RuntimeModel) SetBegin(t time.Time) {
+	r.IsRunning = 1
+	r.BeginTime = t
+}
+
+// 完成执行，有节点或者连接线异常时运行时标记为异常，已经由错误路径处理的节点异常除外
+func (r *RuntimeModel) SetEnd(t time.Time) {
+	r.IsRunning = 0
+	r.EndTime = t
+	r.Timeused = r.EndTime.Sub(r.BeginTime).Milliseconds()
+
+	for _, ast := range r.ActionStates {
+		if ast.IsError == 1 && ast.IsHandled == 0 {
+			r.IsError = 1
+			break
+		}
+	}
+	for _, lst := range r.LinkStates {
+		if lst.IsError == 1 {
+			r.IsError = 1
+			break
+		}
+	}
+}
+
+// 清空节点和连接线状态
+func (r *RuntimeModel) ClearStates() {
+	r.ActionStates = make([]*ActionStateModel, 0)
+	r.LinkStates = make([]*LinkStateModel, 0)
 }
 
 func (r *RuntimeModel) AddRunningLink(param *LinkParam) {
@@ -367,7 +506,7 @@ func (r *RuntimeModel) AddRunningLink(param *LinkParam) {
 		r.RunningLinks = make([]*LinkParam, 0)
 	}
 	for _, link := range r.RunningLinks {
-		if link.SourceId == param.SourceId && link.TargetId == param.TargetId {
+		if link.isSameRunning(param) {
 			return
 		}
 	}
@@ -380,7 +519,7 @@ func (r *RuntimeModel) DelRunningLink(param *LinkParam) {
 		r.RunningLinks = make([]*LinkParam, 0)
 	}
 	for index, link := range r.RunningLinks {
-		if link.SourceId == param.SourceId && link.TargetId == param.TargetId {
+		if link.isSameRunning(param) {
 			r.RunningLinks = append(r.RunningLinks[:index], r.RunningLinks[index+1:]...)
 			return
 		}
@@ -394,7 +533,7 @@ func (r *RuntimeModel) AddRunningAction(param *ActionParam) {
 		r.RunningActions = make([]*ActionParam, 0)
 	}
 	for _, p := range r.RunningActions {
-		if p.ActionId == param.ActionId && p.PreActionId == param.PreActionId {
+		if p.isSameRunning(param) {
 			return
 		}
 	}
@@ -409,7 +548,7 @@ func (r *RuntimeModel) DelRunningAction(param *ActionParam) {
 	}
 
 	for index, p := range r.RunningActions {
-		if p.ActionId == param.ActionId && p.PreActionId == param.PreActionId {
+		if p.isSameRunning(param) {
 			r.RunningActions = append(r.RunningActions[:index], r.RunningActions[index+1:]...)
 			return
 		}
@@ -421,3 +560,125 @@ func (r *RuntimeModel) ToJson() string {
 	data, _ := json.Marshal(r)
 	return string(data)
 }
+
+// 深度复制运行时，流程定义在执行过程中只读，复制后共享
+func (r *RuntimeModel) Clone() *RuntimeModel {
+	c := *r
+
+	if r.RunningLinks != nil {
+		c.RunningLinks = make([]*LinkParam, len(r.RunningLinks))
+		for i, p := range r.RunningLinks {
+			cp := *p
+			c.RunningLinks[i] = &cp
+		}
+	}
+	if r.RunningActions != nil {
+		c.RunningActions = make([]*ActionParam, len(r.RunningActions))
+		for i, p := range r.RunningActions {
+			cp := *p
+			c.RunningActions[i] = &cp
+		}
+	}
+	if r.ActionStates != nil {
+		c.ActionStates = make([]*ActionStateModel, len(r.ActionStates))
+		for i, st := range r.ActionStates {
+			c.ActionStates[i] = st.Clone()
+		}
+	}
+	if r.LinkStates != nil {
+		c.LinkStates = make([]*LinkStateModel, len(r.LinkStates))
+		for i, st := range r.LinkStates {
+			cst := *st
+			c.LinkStates[i] = &cst
+		}
+	}
+	if r.Logs != nil {
+		c.Logs = make([]*LogModel, len(r.Logs))
+		for i, l := range r.Logs {
+			cl := *l
+			c.Logs[i] = &cl
+		}
+	}
+	if r.Param != nil {
+		c.Param = make([]*RuntimeParamModel, len(r.Param))
+		for i, p := range r.Param {
+			c.Param[i] = &RuntimeParamModel{Name: p.Name, Value: copyValue(p.Value)}
+		}
+	}
+
+	return &c
+}
+
+// 深度复制节点状态
+func (a *ActionStateModel) Clone() *ActionStateModel {
+	c := *a
+
+	if a.NextActionIds != nil {
+		c.NextActionIds = append([]string{}, a.NextActionIds...)
+	}
+	if a.CollectIds != nil {
+		c.CollectIds = append([]string{}, a.CollectIds...)
+	}
+	if a.Routes != nil {
+		c.Routes = make([]*ActionRouteModel, len(a.Routes))
+		for i, r := range a.Routes {
+			cr := *r
+			c.Routes[i] = &cr
+		}
+	}
+	if a.Data != nil {
+		c.Data = make([]*ActionDataModel, len(a.Data))
+		for i, d := range a.Data {
+			c.Data[i] = &ActionDataModel{Name: d.Name, Value: copyValue(d.Value)}
+		}
+	}
+	if a.Content != nil {
+		content := *a.Content
+		c.Content = &content
+	}
+	if a.Attempts != nil {
+		c.Attempts = make([]*ActionAttemptModel, len(a.Attempts))
+		for i, at := range a.Attempts {
+			cat := *at
+			c.Attempts[i] = &cat
+		}
+	}
+
+	return &c
+}
+
+// 深度复制数据值，支持脚本中常用的map和数组类型，其他类型直接返回
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = copyValue(item)
+		}
+		return l
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for k, item := range v {
+			m[k] = item
+		}
+		return m
+	case []string:
+		return append([]string{}, v...)
+	case []map[string]interface{}:
+		l := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			l[i] = copyValue(item).(map[string]interface{})
+		}
+		return l
+	case []byte:
+		return append([]byte{}, v...)
+	default:
+		return value
+	}
+}
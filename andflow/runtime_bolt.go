@@ -0,0 +1,152 @@
+package andflow
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltRuntimeBucket = []byte("runtimes")      //运行时
+	boltIndexBucket   = []byte("runtime_index") //运行时索引
+)
+
+// 基于bbolt的嵌入式运行时存储，不依赖外部数据库
+type BoltRuntimeStore struct {
+	Path string
+	db   *bolt.DB
+}
+
+// 打开存储文件，文件不存在时创建
+func OpenBoltRuntimeStore(path string) (*BoltRuntimeStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltRuntimeBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltIndexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltRuntimeStore{Path: path, db: db}, nil
+}
+
+func (s *BoltRuntimeStore) Put(runtime *RuntimeModel) error {
+	data, err := json.Marshal(runtime)
+	if err != nil {
+		return err
+	}
+	index, err := json.Marshal(CreateRuntimeIndex(runtime))
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(runtime.Id)
+		if err := tx.Bucket(boltRuntimeBucket).Put(key, data); err != nil {
+			return err
+		}
+		return tx.Bucket(boltIndexBucket).Put(key, index)
+	})
+}
+
+func (s *BoltRuntimeStore) Get(id string) (*RuntimeModel, error) {
+	var runtime *RuntimeModel
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		runtime, err = getBoltRuntime(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runtime, nil
+}
+
+// 按照查询条件读取运行时，结果按照开始时间排序
+func (s *BoltRuntimeStore) List(query RuntimeQuery) ([]*RuntimeModel, error) {
+	indexes := make([]*RuntimeIndexModel, 0)
+	runtimes := make(map[string]*RuntimeModel)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltIndexBucket).ForEach(func(k, v []byte) error {
+			index := &RuntimeIndexModel{}
+			if err := json.Unmarshal(v, index); err != nil {
+				return err
+			}
+			if query.Match(index) {
+				indexes = append(indexes, index)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, index := range indexes {
+			runtime, err := getBoltRuntime(tx, index.Id)
+			if err != nil {
+				return err
+			}
+			runtimes[index.Id] = runtime
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return indexes[i].BeginTime.Before(indexes[j].BeginTime)
+	})
+
+	list := make([]*RuntimeModel, 0, len(indexes))
+	for _, index := range indexes {
+		list = append(list, runtimes[index.Id])
+	}
+	return list, nil
+}
+
+func (s *BoltRuntimeStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(id)
+		if tx.Bucket(boltRuntimeBucket).Get(key) == nil {
+			return ErrRuntimeNotFound
+		}
+		if err := tx.Bucket(boltRuntimeBucket).Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket(boltIndexBucket).Delete(key)
+	})
+}
+
+func (s *BoltRuntimeStore) Close() error {
+	return s.db.Close()
+}
+
+func getBoltRuntime(tx *bolt.Tx, id string) (*RuntimeModel, error) {
+	data := tx.Bucket(boltRuntimeBucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrRuntimeNotFound
+	}
+	runtime := &RuntimeModel{}
+	err := json.Unmarshal(data, runtime)
+	if err != nil {
+		return nil, err
+	}
+	return runtime, nil
+}
@@ -0,0 +1,96 @@
+package andflow
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认的订阅缓冲大小
+const DEFAULT_EVENT_BUFFER = 256
+
+// 运行时变化事件，事件内容只读
+type RuntimeEvent struct {
+	Seq       int64       `bson:"seq" json:"seq"`                       //序号
+	RuntimeId string      `bson:"runtime_id" json:"runtime_id"`         //运行时ID
+	Kind      string      `bson:"kind" json:"kind"`                     //事件类型，EVENT_*
+	ActionId  string      `bson:"action_id" json:"action_id,omitempty"` //节点ID
+	SourceId  string      `bson:"source_id" json:"source_id,omitempty"` //连接线源ID
+	TargetId  string      `bson:"target_id" json:"target_id,omitempty"` //连接线目的ID
+	Name      string      `bson:"name" json:"name,omitempty"`           //参数或者数据名称
+	OldValue  interface{} `bson:"old_value" json:"old_value,omitempty"` //修改前的值
+	NewValue  interface{} `bson:"new_value" json:"new_value,omitempty"` //修改后的值，添加状态、参数和日志时为添加的内容
+	Time      time.Time   `bson:"time" json:"time"`                     //时间
+}
+
+// 根据日志条目创建事件
+func createRuntimeEvent(entry *JournalEntry) *RuntimeEvent {
+	event := &RuntimeEvent{
+		Seq:       entry.Seq,
+		RuntimeId: entry.RuntimeId,
+		Kind:      entry.Event,
+		ActionId:  entry.ActionId,
+		SourceId:  entry.SourceId,
+		TargetId:  entry.TargetId,
+		Name:      entry.Name,
+		OldValue:  entry.OldValue,
+		NewValue:  entry.Value,
+		Time:      entry.Time,
+	}
+
+	switch {
+	case entry.ActionParam != nil:
+		event.ActionId = entry.ActionParam.ActionId
+		event.NewValue = entry.ActionParam
+	case entry.LinkParam != nil:
+		event.SourceId = entry.LinkParam.SourceId
+		event.TargetId = entry.LinkParam.TargetId
+		event.NewValue = entry.LinkParam
+	case entry.ActionState != nil:
+		event.ActionId = entry.ActionState.ActionId
+		event.NewValue = entry.ActionState
+	case entry.LinkState != nil:
+		event.SourceId = entry.LinkState.SourceActionId
+		event.TargetId = entry.LinkState.TargetActionId
+		event.NewValue = entry.LinkState
+	case entry.Log != nil:
+		event.NewValue = entry.Log
+	case entry.Runtime != nil:
+		event.NewValue = entry.Runtime
+	}
+	return event
+}
+
+// 事件订阅，从C中读取事件，缓冲满时丢弃新的事件，不阻塞流程执行
+type EventSubscription struct {
+	C       <-chan *RuntimeEvent
+	ch      chan *RuntimeEvent
+	dropped int64
+	closed  bool
+	remove  func(sub *EventSubscription)
+	once    sync.Once
+}
+
+// 因为缓冲满而丢弃的事件数量
+func (s *EventSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// 取消订阅并关闭C，缓冲中的事件仍然可以读取
+func (s *EventSubscription) Close() {
+	s.once.Do(func() {
+		s.remove(s)
+	})
+}
+
+// 发送事件，需要在持有运行时写锁时调用
+func (s *EventSubscription) publish(event *RuntimeEvent) {
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- event:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
@@ -0,0 +1,132 @@
+package andflow
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 文件保存的运行时操作，默认每次状态变化都将运行时写入文件，进程崩溃后可以从文件恢复执行
+type FileRuntimeOperation struct {
+	CommonRuntimeOperation
+	Dir string //保存目录
+}
+
+func CreateFileRuntimeOperation(dir string, runtime *RuntimeModel) *FileRuntimeOperation {
+	operation := &FileRuntimeOperation{Dir: dir}
+	operation.Init(runtime)
+	return operation
+}
+
+func (s *FileRuntimeOperation) Init(runtime *RuntimeModel) {
+	s.CommonRuntimeOperation.Init(runtime)
+	s.saver.save = s.Save
+	if s.SavePolicy == nil {
+		s.SavePolicy = &SavePolicy{Mode: SAVE_POLICY_EVENT}
+	}
+}
+
+// 运行时文件路径
+func (s *FileRuntimeOperation) GetFilePath() string {
+	return filepath.Join(s.Dir, s.Runtime.Id+".json")
+}
+
+// 保存运行时到文件，先写临时文件再重命名，保证文件完整
+func (s *FileRuntimeOperation) Save() {
+	if s.Runtime == nil {
+		return
+	}
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	runtime := s.Snapshot()
+	err := writeRuntimeFile(s.GetFilePath(), runtime)
+	if err != nil {
+		s.AddLog("error", "flow", runtime.Flow.Code, runtime.Flow.Name, "保存运行时失败："+err.Error())
+	}
+
+	if s.OnSaveFunc != nil {
+		s.OnSaveFunc(runtime)
+	}
+}
+
+func writeRuntimeFile(path string, runtime *RuntimeModel) error {
+	data, err := json.Marshal(runtime)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// 读取运行时文件
+func LoadFileRuntime(path string) (*RuntimeModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	runtime := &RuntimeModel{}
+	err = json.Unmarshal(data, runtime)
+	if err != nil {
+		return nil, err
+	}
+	return runtime, nil
+}
+
+// 读取目录中保存的所有运行时
+func LoadFileRuntimes(dir string) ([]*RuntimeModel, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimes := make([]*RuntimeModel, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		runtime, err := LoadFileRuntime(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		runtimes = append(runtimes, runtime)
+	}
+	return runtimes, nil
+}
+
+// 恢复目录中没有执行完成的运行时，从RunningActions和RunningLinks继续执行，执行完成后返回
+func RecoverFileRuntimes(dir string, timeout int64) ([]*RuntimeModel, error) {
+	runtimes, err := LoadFileRuntimes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := recoverRuntimes(runtimes, func(runtime *RuntimeModel) RuntimeOperation {
+		return CreateFileRuntimeOperation(dir, runtime)
+	}, timeout)
+
+	return recovered, nil
+}
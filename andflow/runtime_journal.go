@@ -0,0 +1,279 @@
+package andflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//只记录到日志中的事件
+	EVENT_INIT         = "init"         //初始运行时
+	EVENT_LOG          = "log"          //添加日志
+	EVENT_REQUESTID    = "requestid"    //设置请求执行ID
+	EVENT_TIMEOUT      = "timeout"      //设置执行时效
+	EVENT_STATES_CLEAR = "states_clear" //清空节点和连接线状态
+)
+
+var ErrJournalEmpty = errors.New("运行时日志为空")
+var ErrJournalNoInit = errors.New("运行时日志缺少初始记录")
+
+// 运行时日志条目，只记录每次变化的内容
+type JournalEntry struct {
+	Seq         int64             `bson:"seq" json:"seq"`                             //序号
+	Event       string            `bson:"event" json:"event"`                         //事件
+	Time        time.Time         `bson:"time" json:"time"`                           //时间
+	RuntimeId   string            `bson:"runtime_id" json:"runtime_id"`               //运行时ID
+	ActionId    string            `bson:"action_id" json:"action_id,omitempty"`       //节点ID
+	SourceId    string            `bson:"source_id" json:"source_id,omitempty"`       //连接线源ID
+	TargetId    string            `bson:"target_id" json:"target_id,omitempty"`       //连接线目的ID
+	Name        string            `bson:"name" json:"name,omitempty"`                 //参数或者数据名称
+	Value       interface{}       `bson:"value" json:"value,omitempty"`               //设置的值
+	OldValue    interface{}       `bson:"old_value" json:"old_value,omitempty"`       //修改前的值，重建时不使用
+	ActionParam *ActionParam      `bson:"action_param" json:"action_param,omitempty"` //节点执行参数
+	LinkParam   *LinkParam        `bson:"link_param" json:"link_param,omitempty"`     //连接线执行参数
+	ActionState *ActionStateModel `bson:"action_state" json:"action_state,omitempty"` //节点状态
+	LinkState   *LinkStateModel   `bson:"link_state" json:"link_state,omitempty"`     //连接线状态
+	Log         *LogModel         `bson:"log" json:"log,omitempty"`                   //日志
+	Runtime     *RuntimeModel     `bson:"runtime" json:"runtime,omitempty"`           //初始运行时，只在init事件中记录
+}
+
+// 运行时日志，只追加
+type Journal interface {
+	Append(entry *JournalEntry) error
+	Entries() ([]*JournalEntry, error)
+	Close() error
+}
+
+// 内存中的运行时日志
+type MemoryJournal struct {
+	lock    sync.RWMutex
+	entries []*JournalEntry
+}
+
+func CreateMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{entries: make([]*JournalEntry, 0)}
+}
+
+func (j *MemoryJournal) Append(entry *JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *MemoryJournal) Entries() ([]*JournalEntry, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return append([]*JournalEntry{}, j.entries...), nil
+}
+
+func (j *MemoryJournal) Close() error {
+	return nil
+}
+
+// 文件保存的运行时日志，每个条目一行JSON
+type FileJournal struct {
+	Path string
+	lock sync.Mutex
+	file *os.File
+}
+
+// 打开日志文件，文件已经存在时在末尾追加
+func OpenFileJournal(path string) (*FileJournal, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{Path: path, file: f}, nil
+}
+
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	_, err = j.file.Write(data)
+	return err
+}
+
+func (j *FileJournal) Entries() ([]*JournalEntry, error) {
+	return ReadJournalFile(j.Path)
+}
+
+func (j *FileJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Sync()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
+
+// 读取日志文件，最后一行不完整时（写入过程中崩溃）忽略
+func ReadJournalFile(path string) ([]*JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]*JournalEntry, 0)
+	reader := bufio.NewReader(f)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := &JournalEntry{}
+			err = json.Unmarshal(line, entry)
+			if err != nil {
+				if readErr != nil {
+					break
+				}
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// 根据运行时日志重建运行时
+func Replay(journal Journal) (*RuntimeModel, error) {
+	entries, err := journal.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return ReplayEntries(entries)
+}
+
+// 按顺序应用日志条目重建运行时，遇到init事件时从该记录重新开始
+func ReplayEntries(entries []*JournalEntry) (*RuntimeModel, error) {
+	if len(entries) == 0 {
+		return nil, ErrJournalEmpty
+	}
+
+	var runtime *RuntimeModel
+	for _, entry := range entries {
+		if entry.Event == EVENT_INIT {
+			if entry.Runtime == nil {
+				return nil, ErrJournalNoInit
+			}
+			runtime = entry.Runtime.Clone()
+			continue
+		}
+		if runtime == nil {
+			return nil, ErrJournalNoInit
+		}
+		applyJournalEntry(runtime, entry)
+	}
+	return runtime, nil
+}
+
+func applyJournalEntry(r *RuntimeModel, entry *JournalEntry) {
+	switch entry.Event {
+	case EVENT_BEGIN:
+		r.SetBegin(entry.Time)
+	case EVENT_END:
+		r.SetEnd(entry.Time)
+		r.Timeused = journalInt64(entry.Value)
+	case EVENT_MESSAGE:
+		r.Message, _ = entry.Value.(string)
+	case EVENT_FLOWSTATE:
+		r.FlowState = int(journalInt64(entry.Value))
+	case EVENT_ISERROR:
+		r.IsError = int(journalInt64(entry.Value))
+	case EVENT_REQUESTID:
+		r.RequestId, _ = entry.Value.(string)
+	case EVENT_TIMEOUT:
+		r.Timeout = journalInt64(entry.Value)
+	case EVENT_LOG:
+		if entry.Log != nil {
+			log := *entry.Log
+			r.Logs = append(r.Logs, &log)
+		}
+	case EVENT_STATES_CLEAR:
+		r.ClearStates()
+	case EVENT_ACTION_RUNNING_ADD:
+		if entry.ActionParam != nil {
+			param := *entry.ActionParam
+			r.AddRunningAction(&param)
+		}
+	case EVENT_ACTION_RUNNING_DEL:
+		if entry.ActionParam != nil {
+			r.DelRunningAction(entry.ActionParam)
+		}
+	case EVENT_LINK_RUNNING_ADD:
+		if entry.LinkParam != nil {
+			param := *entry.LinkParam
+			r.AddRunningLink(&param)
+		}
+	case EVENT_LINK_RUNNING_DEL:
+		if entry.LinkParam != nil {
+			r.DelRunningLink(entry.LinkParam)
+		}
+	case EVENT_ACTION_STATE_ADD:
+		if entry.ActionState != nil {
+			r.AddActionState(entry.ActionState.Clone())
+		}
+	case EVENT_LINK_STATE_ADD:
+		if entry.LinkState != nil {
+			state := *entry.LinkState
+			r.AddLinkState(&state)
+		}
+	case EVENT_ACTION_STATE_SET:
+		r.SetActionState(entry.ActionId, int(journalInt64(entry.Value)))
+	case EVENT_ACTION_ERROR_SET:
+		r.SetActionError(entry.ActionId, int(journalInt64(entry.Value)))
+	case EVENT_ACTION_DATA_SET:
+		r.SetActionData(entry.ActionId, entry.Name, copyValue(entry.Value))
+	case EVENT_ACTION_ICON_SET:
+		icon, _ := entry.Value.(string)
+		r.SetActionIcon(entry.ActionId, icon)
+	case EVENT_LINK_STATE_SET:
+		r.SetLinkState(entry.SourceId, entry.TargetId, int(journalInt64(entry.Value)))
+	case EVENT_LINK_ERROR_SET:
+		r.SetLinkError(entry.SourceId, entry.TargetId, int(journalInt64(entry.Value)))
+	case EVENT_PARAM_SET:
+		r.SetParam(entry.Name, copyValue(entry.Value))
+	}
+}
+
+// 日志中的整数值，从文件读取时为float64
+func journalInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return n
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,59 @@
+package andflow
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidStateTransition = errors.New("流程状态不能转换")
+
+// 流程状态名称
+var flowStateNames = map[int]string{
+	FLOW_STATE_CREATED:   "created",
+	FLOW_STATE_RUNNING:   "running",
+	FLOW_STATE_PAUSED:    "paused",
+	FLOW_STATE_WAITING:   "waiting",
+	FLOW_STATE_COMPLETED: "completed",
+	FLOW_STATE_FAILED:    "failed",
+	FLOW_STATE_TIMEOUT:   "timed_out",
+	FLOW_STATE_CANCEL:    "cancelled",
+}
+
+// 允许的状态转换，结束状态可以重新执行
+var flowStateTransitions = map[int][]int{
+	FLOW_STATE_CREATED:   {FLOW_STATE_RUNNING, FLOW_STATE_CANCEL},
+	FLOW_STATE_RUNNING:   {FLOW_STATE_PAUSED, FLOW_STATE_WAITING, FLOW_STATE_COMPLETED, FLOW_STATE_FAILED, FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL},
+	FLOW_STATE_PAUSED:    {FLOW_STATE_RUNNING, FLOW_STATE_WAITING, FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL},
+	FLOW_STATE_WAITING:   {FLOW_STATE_RUNNING, FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL},
+	FLOW_STATE_COMPLETED: {FLOW_STATE_RUNNING},
+	FLOW_STATE_FAILED:    {FLOW_STATE_RUNNING},
+	FLOW_STATE_TIMEOUT:   {FLOW_STATE_RUNNING},
+	FLOW_STATE_CANCEL:    {FLOW_STATE_RUNNING},
+}
+
+// 获取流程状态名称
+func GetFlowStateName(state int) string {
+	if name, ok := flowStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+// 是否允许从from状态转换到to状态
+func CanTransitFlowState(from int, to int) bool {
+	for _, state := range flowStateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为结束状态
+func IsFlowStateFinished(state int) bool {
+	switch state {
+	case FLOW_STATE_COMPLETED, FLOW_STATE_FAILED, FLOW_STATE_TIMEOUT, FLOW_STATE_CANCEL:
+		return true
+	}
+	return false
+}
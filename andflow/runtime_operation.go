@@ -1,6 +1,8 @@
 package andflow
 
 import (
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
@@ -12,6 +14,8 @@ const (
 	EVENT_MESSAGE   = "message"
 	EVENT_FLOWSTATE = "flowstate"
 	EVENT_ISERROR   = "iserror"
+	EVENT_PAUSE     = "pause"
+	EVENT_RESUME    = "resume"
 
 	EVENT_ACTION_RUNNING_ADD = "action_running_add"
 	EVENT_ACTION_RUNNING_DEL = "action_running_del"
@@ -36,11 +40,23 @@ const (
 	//operation CMD 控制指令
 	CMD_STOP  = 1 //停止
 	CMD_START = 0 //执行,默认
+	CMD_PAUSE = 2 //暂停
+
+	//流程执行状态
+	FLOW_STATE_CREATED   = 0  //已创建，未执行
+	FLOW_STATE_RUNNING   = 1  //执行中
+	FLOW_STATE_PAUSED    = 2  //已暂停
+	FLOW_STATE_WAITING   = 3  //已停止，还有待执行的节点或者连接线，可以继续执行
+	FLOW_STATE_COMPLETED = 4  //执行完成
+	FLOW_STATE_FAILED    = -1 //执行失败
+	FLOW_STATE_TIMEOUT   = -2 //超时
+	FLOW_STATE_CANCEL    = -3 //取消
 )
 
 type RuntimeOperation interface {
 	Init(runtime *RuntimeModel)
 	GetRuntime() *RuntimeModel
+	Snapshot() *RuntimeModel
 	GetFlow() *FlowModel
 	SetCmd(c int)
 	GetCmd() int
@@ -53,7 +69,8 @@ type RuntimeOperation interface {
 	GetRequestId() string
 	SetBegin()
 	SetEnd()
-	SetState(state int)
+	SetTimeout(timeout int64)
+	SetState(state int) error
 	GetState() int
 	SetError(iserror int)
 	GetError() int
@@ -68,7 +85,9 @@ type RuntimeOperation interface {
 
 	AddActionState(state *ActionStateModel)
 	AddLinkState(state *LinkStateModel)
+	ClearStates()
 
+	GetActionStates(actionId string) []*ActionStateModel
 	GetLastActionState(actionId string) *ActionStateModel
 	GetLastLinkState(sourceId string, targetId string) *LinkStateModel
 
@@ -87,17 +106,139 @@ type RuntimeOperation interface {
 	SetLinkState(sourceId string, targetId string, state int)
 }
 
+// 通用运行时操作，对运行时的修改都加锁，执行过程中需要读取或者序列化运行时请使用Snapshot
 type CommonRuntimeOperation struct {
 	Cmd          int
+	cmdLock      sync.RWMutex
+	lock         sync.RWMutex   //运行时读写锁
 	Wg           sync.WaitGroup //同步控制
 	Runtime      *RuntimeModel
-	OnChangeFunc func(event string, runtime *RuntimeModel)
+	OnChangeFunc func(event string, runtime *RuntimeModel) //同步调用，需要知道变化的内容请使用Subscribe
 	OnSaveFunc   func(runtime *RuntimeModel)
+	Journal      Journal      //运行时日志，记录每次变化
+	Store        RuntimeStore //运行时存储，保存时写入
+	SavePolicy   *SavePolicy  //自动保存策略，为空时只在SetEnd时保存
+
+	saveLock sync.Mutex //保存锁，保证按顺序保存
+	saver    runtimeSaver
+	seq      int64
+
+	subscriptions []*EventSubscription //事件订阅
 }
 
 func (s *CommonRuntimeOperation) Init(runtime *RuntimeModel) {
 	s.Runtime = runtime
 	s.Wg = sync.WaitGroup{}
+	s.saver.save = s.Save
+}
+
+// 运行时发生变化
+func (s *CommonRuntimeOperation) changed(event string) {
+	s.notify(event, false)
+}
+
+// 运行时发生变化，按照保存策略保存后通知OnChangeFunc，isError表示变化的内容是否异常
+func (s *CommonRuntimeOperation) notify(event string, isError bool) {
+	s.saver.notify(s.SavePolicy, event, isError)
+	if s.OnChangeFunc != nil {
+		s.OnChangeFunc(event, s.Runtime)
+	}
+}
+
+// 设置运行时日志，并记录当前运行时作为初始记录
+func (s *CommonRuntimeOperation) SetJournal(journal Journal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Journal = journal
+	if s.Runtime != nil {
+		s.record(&JournalEntry{Event: EVENT_INIT, Runtime: s.Runtime})
+	}
+}
+
+func (s *CommonRuntimeOperation) GetJournal() Journal {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Journal
+}
+
+// 订阅运行时变化事件，buffer为缓冲大小，为0时使用默认大小
+func (s *CommonRuntimeOperation) Subscribe(buffer int) *EventSubscription {
+	if buffer <= 0 {
+		buffer = DEFAULT_EVENT_BUFFER
+	}
+	ch := make(chan *RuntimeEvent, buffer)
+	sub := &EventSubscription{C: ch, ch: ch, remove: s.unsubscribe}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscriptions = append(s.subscriptions, sub)
+	return sub
+}
+
+func (s *CommonRuntimeOperation) unsubscribe(sub *EventSubscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, item := range s.subscriptions {
+		if item == sub {
+			s.subscriptions = append(s.subscriptions[:i:i], s.subscriptions[i+1:]...)
+			break
+		}
+	}
+	sub.closed = true
+	close(sub.ch)
+}
+
+// 记录变化到运行时日志并通知订阅，需要在持有运行时写锁时调用，保证日志顺序和修改顺序一致
+func (s *CommonRuntimeOperation) record(entry *JournalEntry) {
+	if s.Journal == nil && len(s.subscriptions) == 0 {
+		return
+	}
+	s.seq++
+	entry.Seq = s.seq
+	entry.RuntimeId = s.Runtime.Id
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	//复制变化的内容，避免之后的修改影响已经记录的条目
+	entry.Value = copyValue(entry.Value)
+	entry.OldValue = copyValue(entry.OldValue)
+	if entry.ActionParam != nil {
+		param := *entry.ActionParam
+		entry.ActionParam = &param
+	}
+	if entry.LinkParam != nil {
+		param := *entry.LinkParam
+		entry.LinkParam = &param
+	}
+	if entry.ActionState != nil {
+		entry.ActionState = entry.ActionState.Clone()
+	}
+	if entry.LinkState != nil {
+		state := *entry.LinkState
+		entry.LinkState = &state
+	}
+	if entry.Log != nil {
+		l := *entry.Log
+		entry.Log = &l
+	}
+	if entry.Runtime != nil {
+		entry.Runtime = entry.Runtime.Clone()
+	}
+
+	if s.Journal != nil {
+		err := s.Journal.Append(entry)
+		if err != nil {
+			log.Println("journal append error: " + err.Error())
+		}
+	}
+
+	if len(s.subscriptions) > 0 {
+		event := createRuntimeEvent(entry)
+		for _, sub := range s.subscriptions {
+			sub.publish(event)
+		}
+	}
 }
 
 func (s *CommonRuntimeOperation) WaitAdd(d int) {
@@ -111,9 +252,30 @@ func (s *CommonRuntimeOperation) Wait() {
 	s.Wg.Wait()
 }
 func (s *CommonRuntimeOperation) SetCmd(c int) {
+	s.cmdLock.Lock()
+	old := s.Cmd
 	s.Cmd = c
+	s.cmdLock.Unlock()
+
+	if s.Runtime != nil {
+		event := ""
+		if c == CMD_PAUSE && old != CMD_PAUSE {
+			event = EVENT_PAUSE
+		} else if c == CMD_START && old == CMD_PAUSE {
+			event = EVENT_RESUME
+		}
+		if event != "" {
+			s.lock.Lock()
+			s.record(&JournalEntry{Event: event})
+			s.lock.Unlock()
+
+			s.changed(event)
+		}
+	}
 }
 func (s *CommonRuntimeOperation) GetCmd() int {
+	s.cmdLock.RLock()
+	defer s.cmdLock.RUnlock()
 	return s.Cmd
 }
 
@@ -121,12 +283,26 @@ func (s *CommonRuntimeOperation) AddLog(tp, tag, name, title, content string) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.AddLog(tp, tag, name, title, content)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l := s.Runtime.AddLog(tp, tag, name, title, content)
+	s.record(&JournalEntry{Event: EVENT_LOG, Time: l.Time, Log: l})
 }
 
 func (s *CommonRuntimeOperation) GetRuntime() *RuntimeModel {
 	return s.Runtime
 }
+
+// 获取运行时的深度复制，可以在执行过程中安全地读取和序列化
+func (s *CommonRuntimeOperation) Snapshot() *RuntimeModel {
+	if s.Runtime == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Runtime.Clone()
+}
+
 func (s *CommonRuntimeOperation) GetFlow() *FlowModel {
 	if s.Runtime == nil {
 		return nil
@@ -135,9 +311,15 @@ func (s *CommonRuntimeOperation) GetFlow() *FlowModel {
 }
 
 func (s *CommonRuntimeOperation) SetRequestId(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.Runtime.RequestId
 	s.Runtime.RequestId = id
+	s.record(&JournalEntry{Event: EVENT_REQUESTID, Value: id, OldValue: old})
 }
 func (s *CommonRuntimeOperation) GetRequestId() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.RequestId
 }
 
@@ -145,51 +327,58 @@ func (s *CommonRuntimeOperation) SetBegin() {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.IsRunning = 1
-	s.Runtime.BeginTime = time.Now()
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_BEGIN, s.Runtime)
-	}
+	s.lock.Lock()
+	now := time.Now()
+	s.Runtime.SetBegin(now)
+	s.record(&JournalEntry{Event: EVENT_BEGIN, Time: now})
+	s.lock.Unlock()
+
+	s.changed(EVENT_BEGIN)
 }
 func (s *CommonRuntimeOperation) SetEnd() {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.IsRunning = 0
-	s.Runtime.EndTime = time.Now()
-	s.Runtime.Timeused = s.Runtime.EndTime.Sub(s.Runtime.BeginTime).Milliseconds()
+	s.lock.Lock()
+	now := time.Now()
+	s.Runtime.SetEnd(now)
+	s.record(&JournalEntry{Event: EVENT_END, Time: now, Value: s.Runtime.Timeused})
+	s.lock.Unlock()
 
-	for _, ast := range s.Runtime.ActionStates {
-		if ast.IsError == 1 {
-			s.Runtime.IsError = 1
-			break
-		}
-	}
-	for _, lst := range s.Runtime.LinkStates {
-		if lst.IsError == 1 {
-			s.Runtime.IsError = 1
-			break
-		}
-	}
+	s.changed(EVENT_END)
+	s.saver.flush(s.SavePolicy)
+}
 
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_END, s.Runtime)
+// 设置执行时效（毫秒）
+func (s *CommonRuntimeOperation) SetTimeout(timeout int64) {
+	if s.Runtime == nil {
+		return
 	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.Runtime.Timeout
+	s.Runtime.Timeout = timeout
+	s.record(&JournalEntry{Event: EVENT_TIMEOUT, Value: timeout, OldValue: old})
 }
 func (s *CommonRuntimeOperation) SetMessage(message string) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
+	old := s.Runtime.Message
 	s.Runtime.Message = message
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_MESSAGE, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_MESSAGE, Value: message, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_MESSAGE)
 }
 
 func (s *CommonRuntimeOperation) GetMessage() string {
 	if s.Runtime == nil {
 		return ""
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.Message
 }
 
@@ -197,110 +386,170 @@ func (s *CommonRuntimeOperation) SetError(iserror int) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
+	old := s.Runtime.IsError
 	s.Runtime.IsError = iserror
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ISERROR, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_ISERROR, Value: iserror, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ISERROR)
 }
 func (s *CommonRuntimeOperation) GetError() int {
 	if s.Runtime == nil {
 		return 0
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.IsError
 }
 
-func (s *CommonRuntimeOperation) SetState(state int) {
+// 设置流程状态，不允许的状态转换返回ErrInvalidStateTransition
+func (s *CommonRuntimeOperation) SetState(state int) error {
 	if s.Runtime == nil {
-		return
+		return nil
 	}
-	s.Runtime.FlowState = state
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_FLOWSTATE, s.Runtime)
+	s.lock.Lock()
+	old := s.Runtime.FlowState
+	if old == state {
+		s.lock.Unlock()
+		return nil
+	}
+	if !CanTransitFlowState(old, state) {
+		s.lock.Unlock()
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidStateTransition, GetFlowStateName(old), GetFlowStateName(state))
 	}
+	s.Runtime.FlowState = state
+	s.record(&JournalEntry{Event: EVENT_FLOWSTATE, Value: state, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_FLOWSTATE)
+	return nil
 }
 
 func (s *CommonRuntimeOperation) GetState() int {
 	if s.Runtime == nil {
 		return 0
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.FlowState
 }
 func (s *CommonRuntimeOperation) GetRunningActions() []*ActionParam {
 	if s.Runtime == nil {
 		return nil
 	}
-	return s.Runtime.RunningActions
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*ActionParam{}, s.Runtime.RunningActions...)
 }
 
 func (s *CommonRuntimeOperation) GetRunningLinks() []*LinkParam {
 	if s.Runtime == nil {
 		return nil
 	}
-	return s.Runtime.RunningLinks
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*LinkParam{}, s.Runtime.RunningLinks...)
 }
 
 func (s *CommonRuntimeOperation) AddRunningAction(param *ActionParam) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.AddRunningAction(param)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_RUNNING_ADD, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_ACTION_RUNNING_ADD, ActionParam: param})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_RUNNING_ADD)
 }
 
 func (s *CommonRuntimeOperation) DelRunningAction(param *ActionParam) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.DelRunningAction(param)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_RUNNING_DEL, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_ACTION_RUNNING_DEL, ActionParam: param})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_RUNNING_DEL)
 }
 
 func (s *CommonRuntimeOperation) AddRunningLink(param *LinkParam) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.AddRunningLink(param)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_LINK_RUNNING_ADD, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_LINK_RUNNING_ADD, LinkParam: param})
+	s.lock.Unlock()
+
+	s.changed(EVENT_LINK_RUNNING_ADD)
 }
 func (s *CommonRuntimeOperation) DelRunningLink(param *LinkParam) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.DelRunningLink(param)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_LINK_RUNNING_DEL, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_LINK_RUNNING_DEL, LinkParam: param})
+	s.lock.Unlock()
+
+	s.changed(EVENT_LINK_RUNNING_DEL)
 }
 
 func (s *CommonRuntimeOperation) AddActionState(state *ActionStateModel) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.AddActionState(state)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_STATE_ADD, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_ACTION_STATE_ADD, ActionState: state})
+	isError := state.IsError == 1
+	s.lock.Unlock()
+
+	s.notify(EVENT_ACTION_STATE_ADD, isError)
 }
 func (s *CommonRuntimeOperation) AddLinkState(state *LinkStateModel) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
 	s.Runtime.AddLinkState(state)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_LINK_STATE_ADD, s.Runtime)
+	s.record(&JournalEntry{Event: EVENT_LINK_STATE_ADD, LinkState: state})
+	isError := state.IsError == 1
+	s.lock.Unlock()
+
+	s.notify(EVENT_LINK_STATE_ADD, isError)
+}
+
+// 清空节点和连接线状态，从头执行的时候使用
+func (s *CommonRuntimeOperation) ClearStates() {
+	if s.Runtime == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Runtime.ClearStates()
+	s.record(&JournalEntry{Event: EVENT_STATES_CLEAR})
+	s.lock.Unlock()
+}
+
+func (s *CommonRuntimeOperation) GetActionStates(actionId string) []*ActionStateModel {
+	if s.Runtime == nil {
+		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Runtime.GetActionStates(actionId)
 }
 
 func (s *CommonRuntimeOperation) GetLastActionState(actionId string) *ActionStateModel {
 	if s.Runtime == nil {
 		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetLastActionState(actionId)
 }
 
@@ -308,6 +557,8 @@ func (s *CommonRuntimeOperation) GetLastLinkState(sourceId string, targetId stri
 	if s.Runtime == nil {
 		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetLastLinkState(sourceId, targetId)
 }
 
@@ -315,18 +566,25 @@ func (s *CommonRuntimeOperation) SetParam(key string, val interface{}) {
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
+	old := s.Runtime.GetParam(key)
 	s.Runtime.SetParam(key, val)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_PARAM_SET, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_PARAM_SET, Name: key, Value: val, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_PARAM_SET)
 }
 func (s *CommonRuntimeOperation) GetParam(key string) interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetParam(key)
 }
 func (s *CommonRuntimeOperation) GetParamMap() map[string]interface{} {
 	if s.Runtime == nil {
 		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetParamMap()
 }
 
@@ -334,15 +592,20 @@ func (s *CommonRuntimeOperation) SetActionData(actionId string, name string, val
 	if s.Runtime == nil {
 		return
 	}
+	s.lock.Lock()
+	old := s.Runtime.GetActionData(actionId, name)
 	s.Runtime.SetActionData(actionId, name, val)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_DATA_SET, s.Runtime)
-	}
+	s.record(&JournalEntry{Event: EVENT_ACTION_DATA_SET, ActionId: actionId, Name: name, Value: val, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_DATA_SET)
 }
 func (s *CommonRuntimeOperation) GetActionData(actionId string, name string) interface{} {
 	if s.Runtime == nil {
 		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetActionData(actionId, name)
 }
 
@@ -350,6 +613,8 @@ func (s *CommonRuntimeOperation) GetActionDataMap(actionId string) map[string]in
 	if s.Runtime == nil {
 		return nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.Runtime.GetActionDataMap(actionId)
 }
 
@@ -357,52 +622,96 @@ func (s *CommonRuntimeOperation) SetActionIcon(actionId string, icon string) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.SetActionIcon(actionId, icon)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_ICON_SET, s.Runtime)
+	s.lock.Lock()
+	var old interface{}
+	if actionState := s.Runtime.GetLastActionState(actionId); actionState != nil {
+		old = actionState.ActionIcon
 	}
+	s.Runtime.SetActionIcon(actionId, icon)
+	s.record(&JournalEntry{Event: EVENT_ACTION_ICON_SET, ActionId: actionId, Value: icon, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_ICON_SET)
 }
 func (s *CommonRuntimeOperation) SetActionState(actionId string, state int) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.SetActionState(actionId, state)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_STATE_SET, s.Runtime)
+	s.lock.Lock()
+	var old interface{}
+	if actionState := s.Runtime.GetLastActionState(actionId); actionState != nil {
+		old = actionState.State
 	}
+	s.Runtime.SetActionState(actionId, state)
+	s.record(&JournalEntry{Event: EVENT_ACTION_STATE_SET, ActionId: actionId, Value: state, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_STATE_SET)
 }
 func (s *CommonRuntimeOperation) SetActionError(actionId string, isError int) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.SetActionError(actionId, isError)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_ACTION_ERROR_SET, s.Runtime)
+	s.lock.Lock()
+	var old interface{}
+	if actionState := s.Runtime.GetLastActionState(actionId); actionState != nil {
+		old = actionState.IsError
 	}
+	s.Runtime.SetActionError(actionId, isError)
+	s.record(&JournalEntry{Event: EVENT_ACTION_ERROR_SET, ActionId: actionId, Value: isError, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_ACTION_ERROR_SET)
 }
 
 func (s *CommonRuntimeOperation) SetLinkState(sourceId, targetId string, state int) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.SetLinkState(sourceId, targetId, state)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_LINK_STATE_SET, s.Runtime)
+	s.lock.Lock()
+	var old interface{}
+	if linkState := s.Runtime.GetLastLinkState(sourceId, targetId); linkState != nil {
+		old = linkState.State
 	}
+	s.Runtime.SetLinkState(sourceId, targetId, state)
+	s.record(&JournalEntry{Event: EVENT_LINK_STATE_SET, SourceId: sourceId, TargetId: targetId, Value: state, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_LINK_STATE_SET)
 }
 func (s *CommonRuntimeOperation) SetLinkError(sourceId, targetId string, isError int) {
 	if s.Runtime == nil {
 		return
 	}
-	s.Runtime.SetLinkError(sourceId, targetId, isError)
-	if s.OnChangeFunc != nil {
-		s.OnChangeFunc(EVENT_LINK_ERROR_SET, s.Runtime)
+	s.lock.Lock()
+	var old interface{}
+	if linkState := s.Runtime.GetLastLinkState(sourceId, targetId); linkState != nil {
+		old = linkState.IsError
 	}
+	s.Runtime.SetLinkError(sourceId, targetId, isError)
+	s.record(&JournalEntry{Event: EVENT_LINK_ERROR_SET, SourceId: sourceId, TargetId: targetId, Value: isError, OldValue: old})
+	s.lock.Unlock()
+
+	s.changed(EVENT_LINK_ERROR_SET)
 }
 
 func (s *CommonRuntimeOperation) Save() {
+	if s.Runtime == nil || (s.Store == nil && s.OnSaveFunc == nil) {
+		return
+	}
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	runtime := s.Snapshot()
+	if s.Store != nil {
+		err := s.Store.Put(runtime)
+		if err != nil {
+			log.Println("runtime store error: " + err.Error())
+		}
+	}
+
 	if s.OnSaveFunc != nil {
-		s.OnSaveFunc(s.Runtime)
+		s.OnSaveFunc(runtime)
 	}
 }
 
@@ -410,6 +719,15 @@ func (s *CommonRuntimeOperation) SetOnChangeFunc(f func(event string, runtime *R
 	s.OnChangeFunc = f
 }
 
+func (s *CommonRuntimeOperation) SetSavePolicy(policy *SavePolicy) {
+	s.saver.stopLoop()
+	s.SavePolicy = policy
+}
+
+func (s *CommonRuntimeOperation) SetStore(store RuntimeStore) {
+	s.Store = store
+}
+
 func (s *CommonRuntimeOperation) SetOnSaveFunc(f func(runtime *RuntimeModel)) {
 	s.OnSaveFunc = f
 }
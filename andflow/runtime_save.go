@@ -0,0 +1,136 @@
+package andflow
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//运行时自动保存方式
+	SAVE_POLICY_NONE      = "none"      //不自动保存，SetEnd时也不保存
+	SAVE_POLICY_EVENT     = "event"     //每次变化都保存
+	SAVE_POLICY_COUNT     = "count"     //每N次变化保存
+	SAVE_POLICY_INTERVAL  = "interval"  //按照固定间隔保存有变化的运行时
+	SAVE_POLICY_LIFECYCLE = "lifecycle" //只在开始、结束、出错和流程状态变化时保存
+)
+
+// 运行时自动保存策略，不论哪种方式（none除外），SetEnd时都会保存最终状态
+type SavePolicy struct {
+	Mode     string        `bson:"mode" json:"mode"`         //保存方式
+	Count    int           `bson:"count" json:"count"`       //变化次数，count方式使用
+	Interval time.Duration `bson:"interval" json:"interval"` //保存间隔，interval方式使用
+}
+
+// 是否为生命周期事件
+func isLifecycleEvent(event string) bool {
+	switch event {
+	case EVENT_BEGIN, EVENT_END, EVENT_FLOWSTATE, EVENT_ISERROR, EVENT_ACTION_ERROR_SET, EVENT_LINK_ERROR_SET:
+		return true
+	}
+	return false
+}
+
+// 按照保存策略调用保存，短时间内多次变化只保存一次
+type runtimeSaver struct {
+	save    func()
+	lock    sync.Mutex //保存锁
+	changes int64      //变化次数
+	saved   int64      //已经保存的变化次数
+
+	loopLock sync.Mutex
+	stopCh   chan struct{}
+	loopDone chan struct{}
+}
+
+// 运行时发生变化，根据策略决定是否保存
+func (s *runtimeSaver) notify(policy *SavePolicy, event string, isError bool) {
+	n := atomic.AddInt64(&s.changes, 1)
+	if policy == nil {
+		return
+	}
+
+	switch policy.Mode {
+	case SAVE_POLICY_EVENT:
+		s.saveChanges()
+	case SAVE_POLICY_COUNT:
+		if policy.Count <= 1 || n%int64(policy.Count) == 0 {
+			s.saveChanges()
+		}
+	case SAVE_POLICY_LIFECYCLE:
+		if isError || isLifecycleEvent(event) {
+			s.saveChanges()
+		}
+	case SAVE_POLICY_INTERVAL:
+		s.startLoop(policy.Interval)
+	}
+}
+
+// 保存到当前为止的变化，等待保存锁的过程中其他调用已经保存了这次变化时直接返回
+func (s *runtimeSaver) saveChanges() {
+	changes := atomic.LoadInt64(&s.changes)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.saved >= changes || s.save == nil {
+		return
+	}
+	changes = atomic.LoadInt64(&s.changes)
+	s.save()
+	s.saved = changes
+}
+
+// 启动定时保存
+func (s *runtimeSaver) startLoop(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	s.loopLock.Lock()
+	defer s.loopLock.Unlock()
+	if s.stopCh != nil {
+		return
+	}
+	stopCh := make(chan struct{})
+	loopDone := make(chan struct{})
+	s.stopCh = stopCh
+	s.loopDone = loopDone
+
+	go func() {
+		defer close(loopDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				s.saveChanges()
+			}
+		}
+	}()
+}
+
+// 停止定时保存
+func (s *runtimeSaver) stopLoop() {
+	s.loopLock.Lock()
+	stopCh := s.stopCh
+	loopDone := s.loopDone
+	s.stopCh = nil
+	s.loopDone = nil
+	s.loopLock.Unlock()
+
+	if stopCh != nil {
+		close(stopCh)
+		<-loopDone
+	}
+}
+
+// 执行结束，停止定时保存并同步保存最终状态
+func (s *runtimeSaver) flush(policy *SavePolicy) {
+	s.stopLoop()
+	if policy != nil && policy.Mode == SAVE_POLICY_NONE {
+		return
+	}
+	s.saveChanges()
+}
@@ -0,0 +1,167 @@
+package andflow
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrRuntimeNotFound = errors.New("运行时不存在")
+
+// 运行时存储
+type RuntimeStore interface {
+	Put(runtime *RuntimeModel) error
+	Get(id string) (*RuntimeModel, error)
+	List(query RuntimeQuery) ([]*RuntimeModel, error)
+	Delete(id string) error
+	Close() error
+}
+
+// 运行时查询条件，空值表示不限制
+type RuntimeQuery struct {
+	FlowCode    string    //流程编号
+	UserId      string    //用户ID
+	GroupId     string    //所属部门、组
+	States      []int     //流程执行状态
+	OnlyRunning bool      //只查询没有执行完成的运行时
+	BeginFrom   time.Time //开始时间不早于
+	BeginTo     time.Time //开始时间早于
+}
+
+// 运行时索引，查询时不需要读取完整的运行时
+type RuntimeIndexModel struct {
+	Id        string    `bson:"_id" json:"id"`
+	FlowCode  string    `bson:"flow_code" json:"flow_code"`
+	UserId    string    `bson:"user_id" json:"user_id"`
+	GroupId   string    `bson:"group_id" json:"group_id"`
+	FlowState int       `bson:"flow_state" json:"flow_state"`
+	IsRunning int       `bson:"is_running" json:"is_running"`
+	BeginTime time.Time `bson:"begin_time" json:"begin_time"`
+}
+
+func CreateRuntimeIndex(runtime *RuntimeModel) *RuntimeIndexModel {
+	index := &RuntimeIndexModel{
+		Id:        runtime.Id,
+		UserId:    runtime.UserId,
+		GroupId:   runtime.GroupId,
+		FlowState: runtime.FlowState,
+		IsRunning: runtime.IsRunning,
+		BeginTime: runtime.BeginTime,
+	}
+	if runtime.Flow != nil {
+		index.FlowCode = runtime.Flow.Code
+	}
+	return index
+}
+
+// 是否符合查询条件
+func (q *RuntimeQuery) Match(index *RuntimeIndexModel) bool {
+	if q.FlowCode != "" && q.FlowCode != index.FlowCode {
+		return false
+	}
+	if q.UserId != "" && q.UserId != index.UserId {
+		return false
+	}
+	if q.GroupId != "" && q.GroupId != index.GroupId {
+		return false
+	}
+	if q.OnlyRunning && index.IsRunning != 1 {
+		return false
+	}
+	if len(q.States) > 0 {
+		found := false
+		for _, state := range q.States {
+			if state == index.FlowState {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.BeginFrom.IsZero() && index.BeginTime.Before(q.BeginFrom) {
+		return false
+	}
+	if !q.BeginTo.IsZero() && !index.BeginTime.Before(q.BeginTo) {
+		return false
+	}
+	return true
+}
+
+// 使用存储保存的运行时操作，默认每次状态变化都保存运行时，可以通过SetSavePolicy修改
+func CreateStoreRuntimeOperation(store RuntimeStore, runtime *RuntimeModel) *CommonRuntimeOperation {
+	operation := &CommonRuntimeOperation{Store: store, SavePolicy: &SavePolicy{Mode: SAVE_POLICY_EVENT}}
+	operation.Init(runtime)
+	return operation
+}
+
+// 恢复存储中没有执行完成的运行时，从RunningActions和RunningLinks继续执行，执行完成后返回
+func RecoverStoreRuntimes(store RuntimeStore, timeout int64) ([]*RuntimeModel, error) {
+	runtimes, err := store.List(RuntimeQuery{OnlyRunning: true})
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := recoverRuntimes(runtimes, func(runtime *RuntimeModel) RuntimeOperation {
+		return CreateStoreRuntimeOperation(store, runtime)
+	}, timeout)
+
+	return recovered, nil
+}
+
+// 已经执行到最后的运行时，和执行结束时一样按照异常设置结束状态，然后结束
+func finishRecoveredRuntime(operation RuntimeOperation) {
+	state := FLOW_STATE_COMPLETED
+	if operation.GetError() == 1 {
+		state = FLOW_STATE_FAILED
+	}
+	flow := operation.GetFlow()
+	for _, st := range []int{FLOW_STATE_RUNNING, state} {
+		if err := operation.SetState(st); err != nil {
+			log.Println(err)
+			operation.AddLog("error", "flow", flow.Code, flow.Name, err.Error())
+		}
+	}
+	operation.SetEnd()
+}
+
+// 继续执行没有完成的运行时，create为每个运行时创建对应的运行时操作
+func recoverRuntimes(runtimes []*RuntimeModel, create func(runtime *RuntimeModel) RuntimeOperation, timeout int64) []*RuntimeModel {
+	recovered := make([]*RuntimeModel, 0)
+	w := sync.WaitGroup{}
+	for _, runtime := range runtimes {
+		//正常结束的运行时不需要恢复
+		if runtime.IsRunning != 1 {
+			continue
+		}
+		//没有保存流程定义时按照开始时的版本从流程仓库加载
+		if LoadRuntimeFlow(nil, runtime) != nil {
+			continue
+		}
+		recovered = append(recovered, runtime)
+
+		operation := create(runtime)
+
+		//没有待执行的内容，已经执行到最后
+		if len(runtime.RunningActions) == 0 && len(runtime.RunningLinks) == 0 && len(runtime.ActionStates) > 0 {
+			finishRecoveredRuntime(operation)
+			continue
+		}
+
+		t := timeout
+		if t <= 0 {
+			t = runtime.Timeout
+		}
+
+		w.Add(1)
+		go func(operation RuntimeOperation, timeout int64) {
+			defer w.Done()
+			Execute(operation, &CommonFlowRouter{}, &CommonFlowRunner{}, timeout)
+		}(operation, t)
+	}
+	w.Wait()
+
+	return recovered
+}
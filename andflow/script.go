@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dop251/goja"
@@ -164,10 +166,32 @@ func SetCommonLinkScriptFunc(rts *goja.Runtime, session *Session, param *LinkPar
 
 		return rts.ToValue(value)
 	})
+	//错误路径上的源节点错误信息
+	rts.Set("getError", func(call goja.FunctionCall) goja.Value {
+		return getScriptError(rts, param.Error)
+	})
+	//组的第几次迭代
+	rts.Set("getIteration", func(call goja.FunctionCall) goja.Value {
+		return rts.ToValue(param.Iteration)
+	})
 	//通用
 	SetCommonScriptFunc(rts, session)
 }
 
+// 错误信息转换为脚本对象，没有错误时返回null
+func getScriptError(rts *goja.Runtime, e *ActionErrorModel) goja.Value {
+	if e == nil {
+		return goja.Null()
+	}
+	return rts.ToValue(map[string]interface{}{
+		"action_id":  e.ActionId,
+		"runner":     e.Runner,
+		"message":    e.Message,
+		"attempt":    e.Attempt,
+		"is_timeout": e.IsTimeout,
+	})
+}
+
 func SetCommonActionScriptFunc(rts *goja.Runtime, session *Session, param *ActionParam, actionState *ActionStateModel) {
 	actionId := param.ActionId
 	preActionId := param.PreActionId
@@ -362,12 +386,55 @@ func SetCommonActionScriptFunc(rts *goja.Runtime, session *Session, param *Actio
 		return rts.ToValue(value)
 
 	})
+	//通过错误路径到达时，上一个节点的错误信息
+	rts.Set("getError", func(call goja.FunctionCall) goja.Value {
+		return getScriptError(rts, param.Error)
+	})
+	//循环节点的第几次执行，不是循环节点时为组的第几次迭代
+	rts.Set("getIteration", func(call goja.FunctionCall) goja.Value {
+		if param.LoopIndex > 0 {
+			return rts.ToValue(param.LoopIndex)
+		}
+		return rts.ToValue(param.Iteration)
+	})
 	//通用
-	SetCommonScriptFunc(rts, session)
+	setCommonScriptFunc(session.GetActionContext(param), rts, session)
+}
+
+// 在上下文结束的时候中断脚本执行，返回的函数用于停止监听
+func InterruptScriptOnDone(ctx context.Context, rts *goja.Runtime) func() {
+	done := make(chan struct{})
+	once := sync.Once{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			interruptScript(ctx, rts)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// 中断脚本，超时的时候使用节点超时错误
+func interruptScript(ctx context.Context, rts *goja.Runtime) {
+	if ctx.Err() == context.DeadlineExceeded {
+		rts.Interrupt(ErrActionTimeout)
+	} else {
+		rts.Interrupt(ctx.Err())
+	}
 }
 
 // 设置脚本函数
 func SetCommonScriptFunc(rts *goja.Runtime, session *Session) {
+	setCommonScriptFunc(session.Ctx, rts, session)
+}
+
+// 设置脚本函数，sleep和cmd在上下文结束的时候中断
+func setCommonScriptFunc(ctx context.Context, rts *goja.Runtime, session *Session) {
 
 	//打印
 	rts.Set("print", func(call goja.FunctionCall) goja.Value {
@@ -419,7 +486,10 @@ func SetCommonScriptFunc(rts *goja.Runtime, session *Session) {
 			timeout = arg1_timeout.ToInteger()
 		}
 
-		res, err := cmd(command, timeout)
+		res, err := cmd(ctx, command, timeout)
+		if ctx.Err() != nil {
+			interruptScript(ctx, rts)
+		}
 
 		if err != nil {
 			log.Println(err)
@@ -440,7 +510,14 @@ func SetCommonScriptFunc(rts *goja.Runtime, session *Session) {
 			timeout = arg0.ToInteger()
 		}
 
-		time.Sleep(time.Duration(timeout) * time.Millisecond)
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			interruptScript(ctx, rts)
+		case <-timer.C:
+		}
 
 		return goja.Null()
 	})
@@ -760,11 +837,12 @@ func SetCommonScriptFunc(rts *goja.Runtime, session *Session) {
 
 }
 
-func cmd(command string, timeout int64) (string, error) {
+// 执行命令，上下文结束或者超时的时候结束子进程
+func cmd(parent context.Context, command string, timeout int64) (string, error) {
 	var err error
 	var res string
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
 	defer cancel()
 
 	lines := strings.Split(command, "\n")
@@ -781,22 +859,41 @@ func cmd(command string, timeout int64) (string, error) {
 		attr := commandArr[1:]
 
 		cmd := exec.CommandContext(ctx, name, attr...)
+		setCmdProcessGroup(cmd)
 
-		var stdout io.ReadCloser
-
-		if stdout, err = cmd.StdoutPipe(); err != nil { //获取输出对象，可以从该对象中读取输出结果
+		//使用文件管道，命令结束时不等待子进程启动的进程关闭输出
+		var stdout, writer *os.File
+		if stdout, writer, err = os.Pipe(); err != nil {
 			return "", err
 		}
-
 		defer stdout.Close() // 保证关闭输出流
+		cmd.Stdout = writer
 
-		if err = cmd.Start(); err != nil { // 运行命令
+		err = cmd.Start() // 运行命令
+		writer.Close()
+		if err != nil {
 			return "", err
 		}
 
+		output := make(chan []byte, 1)
+		go func() {
+			opBytes, _ := io.ReadAll(stdout) // 读取输出结果
+			output <- opBytes
+		}()
+
 		var opBytes []byte
-		if opBytes, err = io.ReadAll(stdout); err != nil { // 读取输出结果
-			return "", err
+		select {
+		case opBytes = <-output:
+		case <-ctx.Done():
+			//超时或者流程结束，结束整个进程组，关闭输出后不再等待
+			killCmdProcessGroup(cmd)
+			stdout.Close()
+			opBytes = <-output
+		}
+
+		//节点超时或者流程结束，子进程已经被结束
+		if err = cmd.Wait(); err != nil && parent.Err() != nil {
+			return "", parent.Err()
 		}
 
 		res = string(opBytes)
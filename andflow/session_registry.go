@@ -0,0 +1,102 @@
+package andflow
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrSessionNotFound = errors.New("会话不存在")
+
+// 会话查询条件，为空的条件不过滤
+type SessionFilter struct {
+	FlowCode string //流程编码
+	UserId   string //用户ID
+	GroupId  string //所属部门、组
+}
+
+// 正在执行的会话注册表
+type SessionRegistry struct {
+	lock     sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*Session)}
+}
+
+func (r *SessionRegistry) Add(s *Session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[s.Id] = s
+}
+
+func (r *SessionRegistry) Remove(runtimeId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, runtimeId)
+}
+
+func (r *SessionRegistry) Get(runtimeId string) *Session {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.sessions[runtimeId]
+}
+
+// 获取所有会话的副本
+func (r *SessionRegistry) GetAll() map[string]*Session {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	res := make(map[string]*Session, len(r.sessions))
+	for id, s := range r.sessions {
+		res[id] = s
+	}
+	return res
+}
+
+// 按照条件查询会话
+func (r *SessionRegistry) List(filter SessionFilter) []*Session {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	res := make([]*Session, 0)
+	for _, s := range r.sessions {
+		if len(filter.FlowCode) > 0 && s.GetFlow().Code != filter.FlowCode {
+			continue
+		}
+		runtime := s.GetRuntime()
+		if len(filter.UserId) > 0 && runtime.UserId != filter.UserId {
+			continue
+		}
+		if len(filter.GroupId) > 0 && runtime.GroupId != filter.GroupId {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// 取消会话执行
+func (r *SessionRegistry) Cancel(runtimeId string, reason string) error {
+	s := r.Get(runtimeId)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	s.Cancel(reason)
+	return nil
+}
+
+// 等待会话执行结束，会话不存在直接返回
+func (r *SessionRegistry) Wait(ctx context.Context, runtimeId string) error {
+	s := r.Get(runtimeId)
+	if s == nil {
+		return nil
+	}
+	select {
+	case <-s.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"html/template"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func unescapeHTML(s any) template.HTML {
@@ -85,3 +87,18 @@ func ReplaceTemplate(temp string, name string, params map[string]any) (string, e
 
 	return string(b.Bytes()), err
 }
+
+// 解析时长，支持毫秒数值，例如"3000"，或者时长格式，例如"5m"、"1h30m"
+func ParseDuration(str string) (time.Duration, error) {
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return 0, nil
+	}
+
+	ms, err := strconv.ParseInt(str, 10, 64)
+	if err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	return time.ParseDuration(str)
+}
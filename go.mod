@@ -5,10 +5,12 @@ go 1.18
 require (
 	github.com/dop251/goja v0.0.0-20221118162653-d4bf6fde1b86
 	github.com/gofrs/uuid v4.3.1+incompatible
+	go.etcd.io/bbolt v1.3.7
 )
 
 require (
 	github.com/dlclark/regexp2 v1.7.0 // indirect
 	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
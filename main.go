@@ -10,7 +10,7 @@ import (
 
 func main() {
 	file := flag.String("f", "", "流程json文件")
-	timeout := flag.Int64("t", 30000, "超时设置默认30s")
+	timeout := flag.Int64("t", 0, "超时设置（毫秒），默认使用流程定义的执行时效")
 	//解析
 	flag.Parse()
 	if file == nil || len(*file) == 0 {
@@ -60,7 +60,7 @@ func TestDemo1ByStep(t *testing.T) {
 
 	runtime.SetParam("name", "zgq")
 
-	for runtime.FlowState == 0 {
+	for runtime.FlowState == andflow.FLOW_STATE_WAITING {
 		andflow.ExecuteRuntime(runtime, 10000)
 		fmt.Println("执行步骤", step)
 		step = step + 1
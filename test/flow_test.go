@@ -0,0 +1,1692 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zone-7/andflow_go/andflow"
+)
+
+// 创建测试节点
+func createAction(id string, name string) *andflow.ActionModel {
+	return &andflow.ActionModel{Id: id, Name: name, Title: id, Params: make(map[string]string)}
+}
+
+// 创建测试连线
+func createLink(sourceId string, targetId string) *andflow.LinkModel {
+	return &andflow.LinkModel{SourceId: sourceId, TargetId: targetId}
+}
+
+// 统计节点执行和跳过的次数
+func countActionStates(runtime *andflow.RuntimeModel, actionId string) (int, int) {
+	executed := 0
+	skipped := 0
+	for _, st := range runtime.ActionStates {
+		if st.ActionId != actionId {
+			continue
+		}
+		if st.IsSkip == 1 {
+			skipped++
+		} else {
+			executed++
+		}
+	}
+	return executed, skipped
+}
+
+// 测试只执行一次的节点
+func TestActionOnce(t *testing.T) {
+	flow := andflow.CreateFlowModel("once", "只执行一次")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "script"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("a", "c"), createLink("b", "d"), createLink("c", "d"))
+	flow.GetAction("d").Once = "true"
+
+	runtime := andflow.ExecuteFlow(flow, nil, 3000)
+
+	executed, skipped := countActionStates(runtime, "d")
+	fmt.Println("executed:", executed, "skipped:", skipped)
+	if executed != 1 || skipped != 1 {
+		t.Errorf("once action executed %d times, skipped %d times", executed, skipped)
+	}
+
+	//恢复执行时仍然只执行一次
+	runtime.RunningActions = append(runtime.RunningActions, &andflow.ActionParam{RuntimeId: runtime.Id, ActionId: "d", PreActionId: "b"})
+	runtime = andflow.ExecuteRuntime(runtime, 3000)
+
+	executed, skipped = countActionStates(runtime, "d")
+	if executed != 1 || skipped != 2 {
+		t.Errorf("resumed once action executed %d times, skipped %d times", executed, skipped)
+	}
+}
+
+// 测试流程定义的执行时效
+func TestFlowTimeout(t *testing.T) {
+	flow := andflow.CreateFlowModel("timeout", "执行时效")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"))
+	flow.Timeout = "5m"
+
+	runtime := andflow.ExecuteFlow(flow, nil, 0)
+	if runtime.Timeout != 5*60*1000 {
+		t.Errorf("flow timeout not applied: %d", runtime.Timeout)
+	}
+
+	//调用方指定的时效优先
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	if runtime.Timeout != 3000 {
+		t.Errorf("caller timeout not applied: %d", runtime.Timeout)
+	}
+
+	flow.Timeout = "2000"
+	runtime = andflow.ExecuteFlow(flow, nil, 0)
+	if runtime.Timeout != 2000 {
+		t.Errorf("millisecond flow timeout not applied: %d", runtime.Timeout)
+	}
+
+	//格式错误的时效可以解析，执行时记录错误日志，不限制执行时效
+	flow.Timeout = "5 min"
+	data, _ := json.Marshal(flow)
+	if _, err := andflow.ParseFlow(string(data)); err != nil {
+		t.Errorf("invalid flow timeout should still parse: %v", err)
+	}
+	runtime = andflow.ExecuteFlow(flow, nil, 0)
+	if runtime.Timeout != 0 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("invalid flow timeout should not limit execution: %d", runtime.Timeout)
+	}
+	logged := false
+	for _, l := range runtime.Logs {
+		if l.Tp == "error" && l.Tag == "flow" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("invalid flow timeout not logged")
+	}
+}
+
+// 测试节点超时中断脚本
+func TestActionTimeout(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+
+	flow := andflow.CreateFlowModel("action_timeout", "节点超时")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "test_script"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("a", "c"))
+	flow.GetAction("b").ScriptAfter = "while(true){}"
+	flow.GetAction("b").Timeout = "200ms"
+	flow.GetAction("c").ScriptAfter = "sleep(60000)"
+	flow.GetAction("c").SetParam("timeout", "200")
+
+	//命令启动的后台进程持有输出时也按时结束
+	shell := path.Join(os.TempDir(), fmt.Sprintf("andflow_cmd_%d.sh", time.Now().UnixNano()))
+	os.WriteFile(shell, []byte("sleep 8 &\nsleep 8\n"), 0644)
+	defer os.Remove(shell)
+	flow.Actions = append(flow.Actions, createAction("d", "test_script"))
+	flow.Links = append(flow.Links, createLink("a", "d"))
+	flow.GetAction("d").ScriptAfter = fmt.Sprintf(`cmd("sh %s", 60000)`, shell)
+	flow.GetAction("d").Timeout = "300ms"
+
+	t1 := time.Now()
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	used := time.Since(t1)
+	fmt.Println("time used:", used)
+
+	if used > 5*time.Second {
+		t.Errorf("action was not interrupted, time used %v", used)
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		st := runtime.GetLastActionState(id)
+		if st == nil || st.IsTimeout != 1 || st.IsError != 1 {
+			t.Errorf("action %s should fail with timeout: %+v", id, st)
+		}
+	}
+}
+
+// 测试用执行器，前几次执行失败
+type flakyActionRunner struct {
+	failures int
+	count    int
+}
+
+func (r *flakyActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *flakyActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	r.count++
+	if r.count <= r.failures {
+		return andflow.RESULT_FAILURE, errors.New("connection refused")
+	}
+	return andflow.RESULT_SUCCESS, nil
+}
+
+// 测试失败重试
+func TestActionRetry(t *testing.T) {
+	runner := &flakyActionRunner{failures: 2}
+	andflow.RegistActionRunner("test_flaky", runner)
+
+	flow := andflow.CreateFlowModel("retry", "失败重试")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_flaky"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").Retry = &andflow.RetryModel{MaxAttempts: 3, Backoff: andflow.BACKOFF_EXPONENTIAL, Interval: "10", Jitter: 0.5, RetryOn: []string{"refused"}}
+
+	runtime := andflow.ExecuteFlow(flow, nil, 3000)
+
+	st := runtime.GetLastActionState("b")
+	if st == nil || st.State != int(andflow.RESULT_SUCCESS) || len(st.Attempts) != 3 {
+		t.Fatalf("action should succeed after 3 attempts: %+v", st)
+	}
+	if st.Attempts[0].Error == "" || st.Attempts[2].Error != "" {
+		t.Errorf("attempt errors not recorded")
+	}
+	if runtime.GetLastActionState("c") == nil {
+		t.Errorf("next action not executed after retry")
+	}
+
+	//不可重试的错误
+	runner.count = 0
+	flow.GetAction("b").Retry.RetryOn = []string{"timeout"}
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	st = runtime.GetLastActionState("b")
+	if st == nil || st.IsError != 1 || len(st.Attempts) != 1 {
+		t.Errorf("non-retryable error should not be retried: %+v", st)
+	}
+
+	//失败的尝试设置的后续节点和结果数据不保留
+	andflow.RegistActionRunner("test_partial", &partialActionRunner{})
+	flow.GetAction("b").Name = "test_partial"
+	flow.GetAction("b").Retry.RetryOn = nil
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	st = runtime.GetLastActionState("b")
+	if st == nil || st.IsError != 0 || st.GetData("partial") != nil || st.GetData("result") != "ok" {
+		t.Errorf("failed attempt output should be cleared: %+v", st)
+	}
+	if runtime.GetLastActionState("c") == nil {
+		t.Errorf("next action ids of failed attempt should be cleared")
+	}
+
+	//尝试超时后重试，执行时效用于每次尝试
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	flow.GetAction("b").Name = "test_script"
+	flow.GetAction("b").ScriptAfter = `var n = getParam("n") || 0; setParam("n", n + 1); if (n == 0) { while(true){} }`
+	flow.GetAction("b").Timeout = "200ms"
+	flow.GetAction("b").Retry = &andflow.RetryModel{MaxAttempts: 2, Interval: "10", RetryOn: []string{andflow.RETRY_ON_TIMEOUT}}
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	st = runtime.GetLastActionState("b")
+	if st == nil || st.IsError != 0 || len(st.Attempts) != 2 || st.Attempts[0].Error != andflow.ErrActionTimeout.Error() {
+		t.Errorf("timed out attempt should be retried: %+v", st)
+	}
+}
+
+// 测试用执行器，第一次执行设置后续节点和结果数据后失败
+type partialActionRunner struct{}
+
+func (r *partialActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *partialActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	if len(state.Attempts) == 0 {
+		state.NextActionIds = []string{"x"}
+		state.SetData("partial", 1)
+		return andflow.RESULT_FAILURE, errors.New("partial failure")
+	}
+	state.SetData("result", "ok")
+	return andflow.RESULT_SUCCESS, nil
+}
+
+// 测试用执行器，记录上下文信息
+type contextActionRunner struct {
+	runtimeId   string
+	actionId    string
+	hasDeadline bool
+}
+
+func (r *contextActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *contextActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	return andflow.RESULT_FAILURE, errors.New("ExecuteContext should be used")
+}
+
+func (r *contextActionRunner) ExecuteContext(ctx context.Context, s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	r.runtimeId = andflow.GetContextRuntimeId(ctx)
+	r.actionId = andflow.GetContextActionId(ctx)
+	_, r.hasDeadline = ctx.Deadline()
+	return andflow.RESULT_SUCCESS, nil
+}
+
+// 测试用执行器，记录会话中获取的节点上下文是否为本次执行的上下文
+type actionContextRunner struct {
+	lock    sync.Mutex
+	missing int
+}
+
+func (r *actionContextRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *actionContextRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	ctx := s.GetActionContext(param)
+	deadline, ok := ctx.Deadline()
+	//相同节点和上一个节点的其他执行不共用上下文
+	other := *param
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !ok || time.Until(deadline) > 5*time.Second || s.GetActionContext(&other) == ctx {
+		r.missing++
+	}
+	return andflow.RESULT_SUCCESS, nil
+}
+
+// 测试循环执行的节点每次执行使用自己的上下文
+func TestActionContextPerExecution(t *testing.T) {
+	runner := &actionContextRunner{}
+	andflow.RegistActionRunner("test_action_context", runner)
+
+	flow := andflow.CreateFlowModel("action_context", "节点上下文")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_action_context"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").Timeout = "2s"
+	flow.GetAction("b").Loop = andflow.LOOP_UNTIL
+	flow.GetAction("b").LoopCondition = `return getIteration() >= 5`
+
+	runtime := andflow.ExecuteFlow(flow, nil, 60000)
+	if executed, _ := countActionStates(runtime, "b"); executed != 5 {
+		t.Errorf("loop executed %d", executed)
+	}
+	if runner.missing != 0 {
+		t.Errorf("action context lost in %d executions", runner.missing)
+	}
+}
+
+// 测试支持上下文的节点执行器
+func TestContextActionRunner(t *testing.T) {
+	runner := &contextActionRunner{}
+	andflow.RegistActionRunner("test_context", runner)
+
+	flow := andflow.CreateFlowModel("context", "上下文")
+	flow.Actions = append(flow.Actions, createAction("a", "test_context"))
+	flow.GetAction("a").Timeout = "1s"
+
+	runtime := andflow.ExecuteFlow(flow, nil, 0)
+
+	if runner.runtimeId != runtime.Id || runner.actionId != "a" || !runner.hasDeadline {
+		t.Errorf("action context not passed to runner: %+v", runner)
+	}
+	if st := runtime.GetLastActionState("a"); st == nil || st.IsError != 0 {
+		t.Errorf("context runner failed: %+v", st)
+	}
+}
+
+// 测试暂停和恢复执行
+func TestSessionPauseResume(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+
+	flow := andflow.CreateFlowModel("pause", "暂停恢复")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").ScriptAfter = "sleep(200)"
+
+	runtime := andflow.CreateRuntime(flow, nil)
+
+	events := make(map[string]int)
+	lock := sync.Mutex{}
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+	operation.SetOnChangeFunc(func(event string, runtime *andflow.RuntimeModel) {
+		lock.Lock()
+		defer lock.Unlock()
+		events[event]++
+	})
+
+	session := andflow.CreateSession(context.Background(), operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{})
+	done := make(chan bool)
+	go func() {
+		session.Execute()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if !session.Pause() {
+		t.Fatal("pause failed")
+	}
+
+	//正在执行的节点继续完成，后续节点不再分发
+	time.Sleep(800 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("paused session should not finish")
+	default:
+	}
+	snapshot := operation.Snapshot()
+	if snapshot.GetLastActionState("b") == nil || snapshot.GetLastActionState("c") != nil || len(snapshot.RunningLinks) != 1 {
+		t.Errorf("paused session should keep pending links: %+v", snapshot.RunningLinks)
+	}
+
+	if !session.Resume() {
+		t.Fatal("resume failed")
+	}
+	<-done
+
+	if runtime.GetLastActionState("c") == nil {
+		t.Errorf("resumed session should execute pending actions")
+	}
+	if events[andflow.EVENT_PAUSE] != 1 || events[andflow.EVENT_RESUME] != 1 {
+		t.Errorf("pause and resume events not emitted: %v", events)
+	}
+}
+
+// 测试查询和取消正在执行的会话
+func TestCancelSession(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+
+	flow := andflow.CreateFlowModel("cancel", "取消执行")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").ScriptAfter = "sleep(60000)"
+
+	runtime := andflow.CreateRuntime(flow, nil)
+	runtime.UserId = "test_cancel_user"
+
+	done := make(chan bool)
+	go func() {
+		andflow.ExecuteRuntime(runtime, 30000)
+		close(done)
+	}()
+
+	var sessions []*andflow.Session
+	for i := 0; i < 100 && len(sessions) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sessions = andflow.ListSessions(andflow.SessionFilter{FlowCode: "cancel", UserId: "test_cancel_user"})
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("running session not found")
+	}
+
+	t1 := time.Now()
+	if err := andflow.CancelSession(runtime.Id, "canceled by test"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := andflow.WaitSession(ctx, runtime.Id); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	fmt.Println("cancel time used:", time.Since(t1))
+
+	if runtime.Message != "canceled by test" || runtime.FlowState != andflow.FLOW_STATE_CANCEL {
+		t.Errorf("cancel not recorded, message: %s, state: %d", runtime.Message, runtime.FlowState)
+	}
+	if andflow.GetSession(runtime.Id) != nil {
+		t.Errorf("session should be removed after finish")
+	}
+	if andflow.CancelSession(runtime.Id, "again") != andflow.ErrSessionNotFound {
+		t.Errorf("cancel finished session should return not found")
+	}
+}
+
+// 测试用执行器，记录最大并发数
+type concurrentActionRunner struct {
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (r *concurrentActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *concurrentActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	r.lock.Lock()
+	r.running++
+	if r.running > r.max {
+		r.max = r.running
+	}
+	r.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	r.lock.Lock()
+	r.running--
+	r.lock.Unlock()
+	return andflow.RESULT_SUCCESS, nil
+}
+
+// 测试会话工作协程数量限制
+func TestSessionPoolSize(t *testing.T) {
+	runner := &concurrentActionRunner{}
+	andflow.RegistActionRunner("test_concurrent", runner)
+
+	flow := andflow.CreateFlowModel("pool", "工作协程")
+	flow.Actions = append(flow.Actions, createAction("begin", "begin"))
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("a%d", i)
+		flow.Actions = append(flow.Actions, createAction(id, "test_concurrent"))
+		flow.Links = append(flow.Links, createLink("begin", id))
+	}
+
+	runtime := andflow.CreateRuntime(flow, nil)
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+	session := andflow.CreateSession(context.Background(), operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{})
+	session.PoolSize = 2
+
+	andflow.ExecuteSession(session, 10000)
+
+	if runner.max > 2 {
+		t.Errorf("max concurrent actions %d exceeds pool size", runner.max)
+	}
+	if len(runtime.ActionStates) != 11 {
+		t.Errorf("not all actions executed: %d", len(runtime.ActionStates))
+	}
+}
+
+// 测试执行过程中获取运行时快照
+func TestRuntimeSnapshot(t *testing.T) {
+	data, _ := os.ReadFile(demo_path + "/3复杂网络.json")
+	flow, err := andflow.ParseFlow(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime := andflow.CreateRuntime(flow, map[string]interface{}{"list": []interface{}{1, 2, 3}})
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				snapshot := operation.Snapshot()
+				if len(snapshot.ToJson()) == 0 {
+					t.Error("snapshot serialize failed")
+				}
+			}
+		}
+	}()
+
+	andflow.Execute(operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 10000)
+	close(done)
+
+	snapshot := operation.Snapshot()
+	if len(snapshot.ActionStates) != len(runtime.ActionStates) {
+		t.Errorf("snapshot action states not equal")
+	}
+	snapshot.GetParam("list").([]interface{})[0] = 100
+	if runtime.GetParam("list").([]interface{})[0] != 1 {
+		t.Errorf("snapshot should be a deep copy")
+	}
+}
+
+// 测试文件保存运行时并在崩溃后恢复执行
+func TestFileRuntimeRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	flow := andflow.CreateFlowModel("file", "文件保存")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+
+	//正常执行，每次状态变化都保存
+	runtime := andflow.CreateRuntime(flow, nil)
+	andflow.Execute(andflow.CreateFileRuntimeOperation(dir, runtime), &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+
+	saved, err := andflow.LoadFileRuntime(path.Join(dir, runtime.Id+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IsRunning != 0 || len(saved.ActionStates) != 3 {
+		t.Errorf("final state not saved: running %d, states %d", saved.IsRunning, len(saved.ActionStates))
+	}
+
+	//模拟执行到节点b的时候进程崩溃
+	crashed := andflow.CreateRuntime(flow, nil)
+	operation := andflow.CreateFileRuntimeOperation(dir, crashed)
+	operation.SetBegin()
+	operation.AddActionState(&andflow.ActionStateModel{ActionId: "a", State: int(andflow.RESULT_SUCCESS)})
+	operation.AddRunningAction(&andflow.ActionParam{RuntimeId: crashed.Id, ActionId: "b", PreActionId: "a"})
+
+	recovered, err := andflow.RecoverFileRuntimes(dir, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 || recovered[0].Id != crashed.Id {
+		t.Fatalf("crashed runtime not recovered: %d", len(recovered))
+	}
+
+	saved, err = andflow.LoadFileRuntime(path.Join(dir, crashed.Id+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	executed, _ := countActionStates(saved, "a")
+	if saved.IsRunning != 0 || executed != 1 || saved.GetLastActionState("c") == nil {
+		t.Errorf("recovered runtime not continued from running actions")
+	}
+
+	//模拟执行到最后、设置结束状态前进程崩溃，恢复时按照异常设置结束状态
+	for _, isError := range []int{0, 1} {
+		finished := andflow.CreateRuntime(flow, nil)
+		operation = andflow.CreateFileRuntimeOperation(dir, finished)
+		operation.SetBegin()
+		operation.SetState(andflow.FLOW_STATE_RUNNING)
+		operation.AddActionState(&andflow.ActionStateModel{ActionId: "a", State: int(andflow.RESULT_SUCCESS)})
+		operation.SetError(isError)
+
+		if _, err := andflow.RecoverFileRuntimes(dir, 3000); err != nil {
+			t.Fatal(err)
+		}
+		saved, err = andflow.LoadFileRuntime(path.Join(dir, finished.Id+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := andflow.FLOW_STATE_COMPLETED
+		if isError == 1 {
+			state = andflow.FLOW_STATE_FAILED
+		}
+		if saved.IsRunning != 0 || saved.FlowState != state {
+			t.Errorf("finished runtime should be recovered as %s: %s", andflow.GetFlowStateName(state), andflow.GetFlowStateName(saved.FlowState))
+		}
+	}
+}
+
+// 同一个节点在不同迭代、循环次数中或者作为跳过标记时分别记录为待执行
+func TestRunningActionIdentity(t *testing.T) {
+	runtime := &andflow.RuntimeModel{}
+	params := []*andflow.ActionParam{
+		{ActionId: "b", PreActionId: "a", GroupId: "g", Iteration: 1},
+		{ActionId: "b", PreActionId: "a", GroupId: "g", Iteration: 2},
+		{ActionId: "b", PreActionId: "a", LoopIndex: 2},
+		{ActionId: "b", PreActionId: "a", IsSkip: 1},
+	}
+	for _, p := range params {
+		runtime.AddRunningAction(p)
+	}
+	runtime.AddRunningAction(&andflow.ActionParam{ActionId: "b", PreActionId: "a", GroupId: "g", Iteration: 2})
+	if len(runtime.RunningActions) != 4 {
+		t.Fatalf("running actions should be kept per token: %d", len(runtime.RunningActions))
+	}
+	runtime.DelRunningAction(&andflow.ActionParam{ActionId: "b", PreActionId: "a", GroupId: "g", Iteration: 2})
+	if len(runtime.RunningActions) != 3 || runtime.RunningActions[1] != params[2] {
+		t.Errorf("wrong running action removed")
+	}
+
+	runtime.AddRunningLink(&andflow.LinkParam{SourceId: "a", TargetId: "b", GroupId: "g", Iteration: 1})
+	runtime.AddRunningLink(&andflow.LinkParam{SourceId: "a", TargetId: "b", GroupId: "g", Iteration: 2})
+	runtime.DelRunningLink(&andflow.LinkParam{SourceId: "a", TargetId: "b", GroupId: "g", Iteration: 1})
+	if len(runtime.RunningLinks) != 1 || runtime.RunningLinks[0].Iteration != 2 {
+		t.Errorf("wrong running link removed")
+	}
+}
+
+func TestRuntimeJournalReplay(t *testing.T) {
+	data, _ := os.ReadFile(demo_path + "/3复杂网络.json")
+	flow, err := andflow.ParseFlow(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journalPath := path.Join(t.TempDir(), "journal.jsonl")
+	fileJournal, err := andflow.OpenFileJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryJournal := andflow.CreateMemoryJournal()
+
+	runtime := andflow.CreateRuntime(flow, map[string]interface{}{"list": []interface{}{1, 2, 3}})
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+	operation.SetJournal(memoryJournal)
+
+	fileOperation := &andflow.CommonRuntimeOperation{}
+	fileOperation.Init(andflow.CreateRuntime(flow, nil))
+	fileOperation.SetJournal(fileJournal)
+
+	andflow.Execute(operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 10000)
+	andflow.Execute(fileOperation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 10000)
+	fileJournal.Close()
+
+	replayed, err := andflow.Replay(memoryJournal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ToJson() != operation.Snapshot().ToJson() {
+		t.Errorf("replayed runtime not equal to memory journal runtime")
+	}
+
+	entries, err := andflow.ReadJournalFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].Event != andflow.EVENT_INIT {
+		t.Fatalf("journal should begin with init entry")
+	}
+	replayed, err = andflow.ReplayEntries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ToJson() != fileOperation.Snapshot().ToJson() {
+		t.Errorf("replayed runtime not equal to file journal runtime")
+	}
+}
+
+func TestBoltRuntimeStore(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "runtime.db")
+	store, err := andflow.OpenBoltRuntimeStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flow := andflow.CreateFlowModel("bolt", "嵌入式存储")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+
+	//正常执行，每次状态变化都保存
+	runtime := andflow.CreateRuntime(flow, nil)
+	runtime.UserId = "user1"
+	andflow.Execute(andflow.CreateStoreRuntimeOperation(store, runtime), &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+
+	saved, err := store.Get(runtime.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IsRunning != 0 || len(saved.ActionStates) != 3 {
+		t.Errorf("final state not saved: running %d, states %d", saved.IsRunning, len(saved.ActionStates))
+	}
+
+	//模拟执行到节点b的时候进程崩溃，重新打开存储后恢复
+	crashed := andflow.CreateRuntime(flow, nil)
+	operation := andflow.CreateStoreRuntimeOperation(store, crashed)
+	operation.SetBegin()
+	operation.AddActionState(&andflow.ActionStateModel{ActionId: "a", State: int(andflow.RESULT_SUCCESS)})
+	operation.AddRunningAction(&andflow.ActionParam{RuntimeId: crashed.Id, ActionId: "b", PreActionId: "a"})
+	store.Close()
+
+	store, err = andflow.OpenBoltRuntimeStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	list, _ := store.List(andflow.RuntimeQuery{FlowCode: "bolt", OnlyRunning: true})
+	if len(list) != 1 || list[0].Id != crashed.Id {
+		t.Fatalf("running runtime not listed: %d", len(list))
+	}
+	list, _ = store.List(andflow.RuntimeQuery{UserId: "user1"})
+	if len(list) != 1 || list[0].Id != runtime.Id {
+		t.Errorf("list by user failed: %d", len(list))
+	}
+	list, _ = store.List(andflow.RuntimeQuery{BeginFrom: time.Now()})
+	if len(list) != 0 {
+		t.Errorf("list by time range failed: %d", len(list))
+	}
+
+	recovered, err := andflow.RecoverStoreRuntimes(store, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 || recovered[0].Id != crashed.Id {
+		t.Fatalf("crashed runtime not recovered: %d", len(recovered))
+	}
+
+	saved, err = store.Get(crashed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IsRunning != 0 || saved.GetLastActionState("c") == nil {
+		t.Errorf("recovered runtime not continued from running actions")
+	}
+
+	err = store.Delete(crashed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(crashed.Id); !errors.Is(err, andflow.ErrRuntimeNotFound) {
+		t.Errorf("runtime not deleted: %v", err)
+	}
+}
+
+func TestSavePolicy(t *testing.T) {
+	flow := andflow.CreateFlowModel("save", "自动保存")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+
+	execute := func(policy *andflow.SavePolicy) (int, int, *andflow.RuntimeModel) {
+		lock := sync.Mutex{}
+		saves := 0
+		events := 0
+		var last *andflow.RuntimeModel
+
+		operation := &andflow.CommonRuntimeOperation{}
+		operation.Init(andflow.CreateRuntime(flow, nil))
+		operation.SetSavePolicy(policy)
+		operation.SetOnChangeFunc(func(event string, runtime *andflow.RuntimeModel) {
+			lock.Lock()
+			events++
+			lock.Unlock()
+		})
+		operation.SetOnSaveFunc(func(runtime *andflow.RuntimeModel) {
+			lock.Lock()
+			saves++
+			last = runtime
+			lock.Unlock()
+		})
+		andflow.Execute(operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+		return saves, events, last
+	}
+
+	saves, events, last := execute(&andflow.SavePolicy{Mode: andflow.SAVE_POLICY_EVENT})
+	if saves == 0 || saves > events || last.IsRunning != 0 {
+		t.Errorf("event policy: saves %d, events %d", saves, events)
+	}
+
+	saves, events, last = execute(&andflow.SavePolicy{Mode: andflow.SAVE_POLICY_COUNT, Count: 5})
+	if saves > events/5+1 || last == nil || last.IsRunning != 0 {
+		t.Errorf("count policy: saves %d, events %d", saves, events)
+	}
+
+	saves, events, last = execute(&andflow.SavePolicy{Mode: andflow.SAVE_POLICY_LIFECYCLE})
+	if saves < 2 || saves >= events || last.IsRunning != 0 || len(last.ActionStates) != 3 {
+		t.Errorf("lifecycle policy should save on begin and end: saves %d, events %d", saves, events)
+	}
+
+	saves, _, last = execute(&andflow.SavePolicy{Mode: andflow.SAVE_POLICY_INTERVAL, Interval: time.Hour})
+	if saves != 1 || last.IsRunning != 0 {
+		t.Errorf("interval policy should save final state: %d", saves)
+	}
+
+	//没有设置保存策略时，结束时保存最终状态
+	saves, _, last = execute(nil)
+	if saves != 1 || last.IsRunning != 0 {
+		t.Errorf("final state should be saved: %d", saves)
+	}
+
+	saves, _, _ = execute(&andflow.SavePolicy{Mode: andflow.SAVE_POLICY_NONE})
+	if saves != 0 {
+		t.Errorf("none policy should not save: %d", saves)
+	}
+}
+
+func TestRuntimeEventSubscribe(t *testing.T) {
+	flow := andflow.CreateFlowModel("event", "事件订阅")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").ScriptAfter = `setParam("count", 1); setParam("count", 2)`
+
+	runtime := andflow.CreateRuntime(flow, nil)
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+
+	sub := operation.Subscribe(0)
+	small := operation.Subscribe(1)
+	andflow.Execute(operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+	sub.Close()
+	small.Close()
+
+	kinds := make(map[string]int)
+	paramChanged := false
+	var last int64
+	for event := range sub.C {
+		if event.RuntimeId != runtime.Id || event.Seq <= last {
+			t.Errorf("event out of order: %s %d", event.Kind, event.Seq)
+		}
+		last = event.Seq
+		kinds[event.Kind]++
+
+		if event.Kind == andflow.EVENT_ACTION_STATE_ADD && event.ActionId == "" {
+			t.Errorf("action state event without action id")
+		}
+		if event.Kind == andflow.EVENT_PARAM_SET && event.Name == "count" && fmt.Sprint(event.OldValue) == "1" && fmt.Sprint(event.NewValue) == "2" {
+			paramChanged = true
+		}
+	}
+	if kinds[andflow.EVENT_BEGIN] != 1 || kinds[andflow.EVENT_END] != 1 || kinds[andflow.EVENT_ACTION_STATE_ADD] != 3 {
+		t.Errorf("unexpected events: %v", kinds)
+	}
+	if !paramChanged {
+		t.Errorf("param change should carry old and new value")
+	}
+
+	//缓冲满时丢弃事件，不阻塞执行
+	received := 0
+	for range small.C {
+		received++
+	}
+	if received != 1 || small.Dropped() == 0 {
+		t.Errorf("small subscription received %d, dropped %d", received, small.Dropped())
+	}
+}
+
+func TestFlowLifecycle(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	andflow.RegistActionRunner("test_flaky", &flakyActionRunner{failures: 100})
+
+	flow := andflow.CreateFlowModel("lifecycle", "执行状态")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").ScriptAfter = "sleep(200)"
+
+	//暂停后停止，保留待执行的连接线
+	runtime := andflow.CreateRuntime(flow, nil)
+	if runtime.FlowState != andflow.FLOW_STATE_CREATED {
+		t.Errorf("new runtime should be created: %d", runtime.FlowState)
+	}
+	operation := &andflow.CommonRuntimeOperation{}
+	operation.Init(runtime)
+	session := andflow.CreateSession(context.Background(), operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{})
+	done := make(chan bool)
+	go func() {
+		session.Execute()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	session.Pause()
+	if operation.GetState() != andflow.FLOW_STATE_PAUSED {
+		t.Errorf("paused session state: %s", andflow.GetFlowStateName(operation.GetState()))
+	}
+	time.Sleep(800 * time.Millisecond)
+	session.Stop()
+	<-done
+	if runtime.FlowState != andflow.FLOW_STATE_WAITING {
+		t.Errorf("stopped session with pending links should be waiting: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//继续执行到结束
+	andflow.Execute(operation, &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED || runtime.GetLastActionState("c") == nil {
+		t.Errorf("continued session should be completed: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	err := operation.SetState(andflow.FLOW_STATE_PAUSED)
+	if !errors.Is(err, andflow.ErrInvalidStateTransition) || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("completed runtime should not be paused: %v", err)
+	}
+
+	//节点失败
+	failed := andflow.CreateFlowModel("lifecycle_failed", "执行失败")
+	failed.Actions = append(failed.Actions, createAction("a", "begin"), createAction("b", "test_flaky"))
+	failed.Links = append(failed.Links, createLink("a", "b"))
+	runtime = andflow.ExecuteFlow(failed, nil, 3000)
+	if runtime.FlowState != andflow.FLOW_STATE_FAILED {
+		t.Errorf("failed runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//执行时效和执行结束几乎同时到达，只有一方设置结束状态
+	race := andflow.CreateFlowModel("lifecycle_race", "结束状态")
+	race.Actions = append(race.Actions, createAction("a", "begin"), createAction("b", "script"))
+	race.Links = append(race.Links, createLink("a", "b"))
+	for i := 0; i < 20; i++ {
+		runtime = andflow.ExecuteFlow(race, nil, 1)
+		for _, l := range runtime.Logs {
+			if l.Tp == "error" && l.Tag == "flow" {
+				t.Errorf("end state set twice: %s", l.Content)
+			}
+		}
+		if runtime.FlowState != andflow.FLOW_STATE_COMPLETED && runtime.FlowState != andflow.FLOW_STATE_TIMEOUT {
+			t.Errorf("end state: %s", andflow.GetFlowStateName(runtime.FlowState))
+		}
+	}
+}
+
+// 创建汇聚测试流程：a分成b、c两路，在汇聚节点d合并后到e
+func createCollectFlow(code string) *andflow.FlowModel {
+	flow := andflow.CreateFlowModel(code, "汇聚")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "script"), createAction("d", "script"), createAction("e", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("a", "c"), createLink("b", "d"), createLink("c", "d"), createLink("d", "e"))
+	flow.GetAction("d").Collect = "true"
+	return flow
+}
+
+func TestDeadPathElimination(t *testing.T) {
+	andflow.RegistActionRunner("test_flaky", &flakyActionRunner{failures: 100})
+
+	//过滤拒绝的分支
+	flow := createCollectFlow("dpe_reject")
+	flow.GetLinkBySourceIdAndTargetId("a", "b").Filter = "return 0"
+	runtime := andflow.ExecuteFlow(flow, nil, 3000)
+
+	executed, skipped := countActionStates(runtime, "b")
+	if executed != 0 || skipped != 1 {
+		t.Errorf("rejected branch should be skipped: executed %d, skipped %d", executed, skipped)
+	}
+	if st := runtime.GetLastLinkState("a", "b"); st == nil || st.IsSkip != 1 {
+		t.Errorf("rejected link resolution not recorded")
+	}
+	if st := runtime.GetLastLinkState("b", "d"); st == nil || st.IsSkip != 1 {
+		t.Errorf("skipped token not propagated to join")
+	}
+	executed, _ = countActionStates(runtime, "d")
+	if executed != 1 || runtime.GetLastActionState("e") == nil {
+		t.Errorf("join should fire once: %d", executed)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED || len(runtime.RunningLinks) != 0 {
+		t.Errorf("runtime should complete: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//失败的分支
+	flow = createCollectFlow("dpe_failure")
+	flow.GetAction("b").Name = "test_flaky"
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	executed, _ = countActionStates(runtime, "d")
+	if executed != 1 || runtime.GetLastActionState("e") == nil {
+		t.Errorf("join should fire after failed branch: %d", executed)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_FAILED {
+		t.Errorf("runtime with failed action should fail: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//所有分支都被拒绝，汇聚节点和后续节点都跳过
+	flow = createCollectFlow("dpe_dead")
+	flow.GetLinkBySourceIdAndTargetId("a", "b").Filter = "return 0"
+	flow.GetLinkBySourceIdAndTargetId("a", "c").Filter = "return 0"
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	_, skipped = countActionStates(runtime, "d")
+	if skipped != 1 {
+		t.Errorf("join without passed links should be skipped: %d", skipped)
+	}
+	if executed, _ = countActionStates(runtime, "e"); executed != 0 {
+		t.Errorf("action after dead join should not execute")
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("dead path runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//节点拒绝执行不是死路径，保留在待执行列表中，下次执行时重试
+	flow = createCollectFlow("dpe_wait")
+	flow.GetAction("b").ScriptBefore = "return 0"
+	runtime = andflow.ExecuteFlow(flow, nil, 3000)
+	if executed, skipped := countActionStates(runtime, "d"); executed != 0 || skipped != 0 {
+		t.Errorf("join should wait for rejected action: executed %d, skipped %d", executed, skipped)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_WAITING || len(runtime.RunningActions) != 1 {
+		t.Errorf("rejected action should keep waiting: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+	flow.GetAction("b").ScriptBefore = "return 1"
+	runtime = andflow.ExecuteRuntime(runtime, 3000)
+	if executed, _ := countActionStates(runtime, "d"); executed != 1 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("join should fire after rejected action runs: %d %s", executed, andflow.GetFlowStateName(runtime.FlowState))
+	}
+}
+
+// 测试用执行器，按照节点参数delay等待后完成，上下文结束时失败
+type slowActionRunner struct{}
+
+func (r *slowActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *slowActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	return r.ExecuteContext(s.GetActionContext(param), s, param, state)
+}
+
+func (r *slowActionRunner) ExecuteContext(ctx context.Context, s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	delay, _ := andflow.ParseDuration(s.GetFlow().GetAction(param.ActionId).GetParam("delay"))
+	select {
+	case <-time.After(delay):
+		return andflow.RESULT_SUCCESS, nil
+	case <-ctx.Done():
+		return andflow.RESULT_FAILURE, ctx.Err()
+	}
+}
+
+// 创建三路汇聚的测试流程，b、c、f分别按照设置的时长执行
+func createJoinFlow(code string, mode string, delays ...string) *andflow.FlowModel {
+	flow := andflow.CreateFlowModel(code, "汇聚方式")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("d", "script"), createAction("e", "end"))
+	for i, id := range []string{"b", "c", "f"} {
+		action := createAction(id, "test_slow")
+		action.Params["delay"] = delays[i]
+		flow.Actions = append(flow.Actions, action)
+		flow.Links = append(flow.Links, createLink("a", id), createLink(id, "d"))
+	}
+	flow.Links = append(flow.Links, createLink("d", "e"))
+	flow.GetAction("d").CollectMode = mode
+	return flow
+}
+
+func TestCollectMode(t *testing.T) {
+	andflow.RegistActionRunner("test_slow", &slowActionRunner{})
+
+	//3个路径中2个通过后执行，取消还在执行的路径
+	flow := createJoinFlow("join_count", andflow.COLLECT_MODE_COUNT, "10", "10", "5s")
+	flow.GetAction("d").CollectCount = 2
+	flow.GetAction("d").CollectCancel = "true"
+	begin := time.Now()
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	if time.Since(begin) > 3*time.Second {
+		t.Errorf("pending branch should be cancelled")
+	}
+	executed, _ := countActionStates(runtime, "d")
+	if st := runtime.GetLastActionState("d"); executed != 1 || len(st.CollectIds) != 2 || arrayContains(st.CollectIds, "f") {
+		t.Errorf("count join should fire once with 2 links: %d %+v", executed, st)
+	}
+	if st := runtime.GetLastActionState("f"); st == nil || st.IsSkip != 1 || st.IsError != 0 {
+		t.Errorf("cancelled branch should be skipped: %+v", st)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("count join runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//第一个到达后执行，其余路径忽略
+	flow = createJoinFlow("join_first", andflow.COLLECT_MODE_FIRST, "10", "300ms", "300ms")
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	executed, _ = countActionStates(runtime, "d")
+	if st := runtime.GetLastActionState("d"); executed != 1 || len(st.CollectIds) != 1 || st.CollectIds[0] != "b" {
+		t.Errorf("first join should fire once on first arrival: %d %+v", executed, st)
+	}
+	if executed, _ = countActionStates(runtime, "f"); executed != 1 {
+		t.Errorf("ignored branch should still execute")
+	}
+
+	//等待超时后按照已经到达的路径执行
+	flow = createJoinFlow("join_timeout", andflow.COLLECT_MODE_TIMEOUT, "10", "10", "800ms")
+	flow.GetAction("d").CollectTimeout = "200ms"
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	executed, _ = countActionStates(runtime, "d")
+	st := runtime.GetLastActionState("d")
+	if executed != 1 || len(st.CollectIds) != 2 || st.BeginTime.After(runtime.GetLastActionState("f").EndTime) {
+		t.Errorf("timeout join should fire before slow branch arrives: %d %+v", executed, st)
+	}
+
+	//环路中的汇聚节点每次到达都等待所有路径，返回的路径执行2次后拒绝
+	flow = andflow.CreateFlowModel("join_cycle", "环路汇聚")
+	flow.Actions = append(flow.Actions, createAction("s", "begin"), createAction("a", "script"), createAction("b", "script"), createAction("c", "script"), createAction("d", "script"))
+	flow.Links = append(flow.Links, createLink("s", "a"), createLink("a", "b"), createLink("a", "c"), createLink("b", "d"), createLink("c", "d"), createLink("d", "a"))
+	flow.GetAction("d").Collect = "true"
+	flow.GetLinkBySourceIdAndTargetId("d", "a").Filter = `var n = (getParam("n") || 0) + 1; setParam("n", n); return n < 3 ? 1 : 0`
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, _ = countActionStates(runtime, "d"); executed != 3 {
+		t.Errorf("join in cycle should fire on every visit: %d", executed)
+	}
+	for _, st := range runtime.ActionStates {
+		if st.ActionId == "d" && len(st.CollectIds) != 2 {
+			t.Errorf("join in cycle should wait for both links: %+v", st)
+		}
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("cycle join runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+}
+
+func arrayContains(array []string, val string) bool {
+	for _, item := range array {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// 创建排他路由流程：a按照顺序判断到b、c、d的路径，e为默认路径
+func createGatewayFlow(code string, filters ...string) *andflow.FlowModel {
+	flow := andflow.CreateFlowModel(code, "排他路由")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"))
+	for i, id := range []string{"b", "c", "d", "e"} {
+		flow.Actions = append(flow.Actions, createAction(id, "end"))
+		link := createLink("a", id)
+		if i < len(filters) {
+			link.Filter = filters[i]
+		}
+		flow.Links = append(flow.Links, link)
+	}
+	flow.GetAction("a").Gateway = andflow.GATEWAY_EXCLUSIVE
+	flow.GetLinkBySourceIdAndTargetId("a", "b").Order = 2
+	flow.GetLinkBySourceIdAndTargetId("a", "c").Order = 1
+	flow.GetLinkBySourceIdAndTargetId("a", "d").Order = 3
+	flow.GetLinkBySourceIdAndTargetId("a", "e").Default = "true"
+	return flow
+}
+
+func TestExclusiveGateway(t *testing.T) {
+	//按照顺序选择第一个满足条件的路径
+	flow := createGatewayFlow("gateway_order", "return 1", "return 0", "return 1")
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	for id, n := range map[string]int{"b": 1, "c": 0, "d": 0, "e": 0} {
+		if executed, _ := countActionStates(runtime, id); executed != n {
+			t.Errorf("action %s executed %d, expect %d", id, executed, n)
+		}
+	}
+	routes := runtime.GetLastActionState("a").Routes
+	if len(routes) != 2 || routes[0].TargetId != "c" || routes[0].IsChosen != 0 || routes[1].TargetId != "b" || routes[1].IsChosen != 1 {
+		t.Errorf("routes should be evaluated in order: %+v", routes)
+	}
+
+	//都不满足时选择默认路径
+	flow = createGatewayFlow("gateway_default", "return 0", "return 0", "return 0")
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, _ := countActionStates(runtime, "e"); executed != 1 {
+		t.Errorf("default link should be taken")
+	}
+	routes = runtime.GetLastActionState("a").Routes
+	if len(routes) != 4 || routes[3].IsDefault != 1 || routes[3].IsChosen != 1 {
+		t.Errorf("default route should be recorded: %+v", routes)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("default route runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//都不满足并且没有默认路径时节点失败
+	flow = createGatewayFlow("gateway_none", "return 0", "return 0", "return 0")
+	flow.GetLinkBySourceIdAndTargetId("a", "e").Default = ""
+	flow.GetLinkBySourceIdAndTargetId("a", "e").Filter = "return 0"
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if st := runtime.GetLastActionState("a"); st.IsError != 1 || len(runtime.LinkStates) != 0 {
+		t.Errorf("no route should fail the action: %+v", st)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_FAILED {
+		t.Errorf("no route runtime state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//路径判断受节点执行时效限制
+	flow = createGatewayFlow("gateway_timeout", "", "while(true){}")
+	flow.GetAction("a").Timeout = "200"
+	begin := time.Now()
+	runtime = andflow.ExecuteFlow(flow, nil, 5000)
+	if time.Since(begin) > 2*time.Second || runtime.GetLastActionState("b") == nil {
+		t.Errorf("route filter should be interrupted by action timeout: %v", time.Since(begin))
+	}
+}
+
+func TestErrorLink(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	runner := &flakyActionRunner{failures: 10}
+	andflow.RegistActionRunner("test_flaky", runner)
+
+	flow := andflow.CreateFlowModel("error_link", "错误路径")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_flaky"), createAction("c", "end"), createAction("d", "test_script"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("b", "d"))
+	flow.GetAction("b").Retry = &andflow.RetryModel{MaxAttempts: 2, Interval: "10"}
+	flow.GetAction("d").ScriptAfter = `var e = getError(); setParam("runner", e.runner); setParam("message", e.message); setParam("attempt", e.attempt);`
+	flow.GetLinkBySourceIdAndTargetId("b", "d").On = andflow.LINK_ON_ERROR
+	flow.GetLinkBySourceIdAndTargetId("b", "d").Filter = "return getError() != null ? 1 : 0"
+
+	//失败时按照错误路径执行，错误信息传递给后续节点
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	if st := runtime.GetLastActionState("b"); st == nil || st.IsError != 1 || st.IsHandled != 1 {
+		t.Errorf("failed action should be handled by error link: %+v", st)
+	}
+	if executed, _ := countActionStates(runtime, "c"); executed != 0 {
+		t.Errorf("success link should not be followed on failure")
+	}
+	if runtime.GetParam("runner") != "test_flaky" || runtime.GetParam("message") != "connection refused" || fmt.Sprint(runtime.GetParam("attempt")) != "2" {
+		t.Errorf("error object not available to script: %v", runtime.GetParamMap())
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED || runtime.IsError != 0 {
+		t.Errorf("handled error runtime state: %s %d", andflow.GetFlowStateName(runtime.FlowState), runtime.IsError)
+	}
+
+	//成功时不执行错误路径
+	runner.failures = 0
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, _ := countActionStates(runtime, "d"); executed != 0 || runtime.GetLastActionState("c") == nil {
+		t.Errorf("error link should only be followed on failure")
+	}
+}
+
+// 测试用补偿执行器，记录补偿的节点
+type compensateActionRunner struct {
+	lock    sync.Mutex
+	actions []string
+}
+
+func (r *compensateActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *compensateActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if param.IsCompensate == 1 {
+		r.actions = append(r.actions, param.ActionId)
+	}
+	return andflow.RESULT_SUCCESS, nil
+}
+
+func TestCompensate(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	andflow.RegistActionRunner("test_flaky", &flakyActionRunner{failures: 10})
+	compensator := &compensateActionRunner{}
+	andflow.RegistActionRunner("test_compensate", compensator)
+
+	flow := andflow.CreateFlowModel("compensate", "补偿")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "test_script"), createAction("d", "test_flaky"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "d"))
+	flow.GetAction("b").Compensate = `setParam("undo_b", "b")`
+	flow.GetAction("c").Compensate = `setParam("undo_c", "c")`
+	flow.GetAction("c").Compensator = "test_compensate"
+
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	if runtime.FlowState != andflow.FLOW_STATE_FAILED {
+		t.Fatalf("runtime should fail: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+	//补偿执行器代替补偿脚本，按照完成顺序倒序补偿
+	if len(compensator.actions) != 1 || compensator.actions[0] != "c" || runtime.GetParam("undo_c") != nil {
+		t.Errorf("compensator should replace compensate script: %v", compensator.actions)
+	}
+	ids := make([]string, 0)
+	for _, st := range runtime.ActionStates {
+		if st.IsCompensate == 1 {
+			ids = append(ids, st.ActionId)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "c" || ids[1] != "b" || runtime.GetParam("undo_b") != "b" {
+		t.Errorf("compensations should run in reverse completion order: %v", ids)
+	}
+
+	//执行成功不补偿
+	flow.GetAction("d").Name = "end"
+	compensator.actions = nil
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED || len(compensator.actions) != 0 {
+		t.Errorf("completed runtime should not be compensated")
+	}
+
+	//流程超时后补偿已经完成的节点
+	andflow.RegistActionRunner("test_slow", &slowActionRunner{})
+	flow.GetAction("d").Name = "test_slow"
+	flow.GetAction("d").SetParam("delay", "5s")
+	runtime = andflow.ExecuteFlow(flow, nil, 300)
+	if runtime.FlowState != andflow.FLOW_STATE_TIMEOUT {
+		t.Fatalf("runtime should time out: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+	if len(compensator.actions) != 1 || runtime.GetParam("undo_b") != "b" {
+		t.Errorf("timed out runtime should be compensated: %v", compensator.actions)
+	}
+}
+
+func TestSubflow(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	andflow.RegistActionRunner("test_slow", &slowActionRunner{})
+
+	child := andflow.CreateFlowModel("subflow_child", "子流程")
+	child.Actions = append(child.Actions, createAction("a", "begin"), createAction("b", "test_script"))
+	child.Links = append(child.Links, createLink("a", "b"))
+	child.GetAction("b").ScriptAfter = `setParam("result", getParam("x") * 2)`
+	andflow.RegistFlow(child)
+
+	slow := andflow.CreateFlowModel("subflow_slow", "慢子流程")
+	slow.Actions = append(slow.Actions, createAction("a", "test_slow"))
+	slow.GetAction("a").SetParam("delay", "5s")
+	andflow.RegistFlow(slow)
+
+	//同步执行，映射参数和结果
+	flow := andflow.CreateFlowModel("subflow_parent", "父流程")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", andflow.SUBFLOW_RUNNER), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").SetParam("flow_code", "subflow_child")
+	flow.GetAction("b").SetParam("input", "x=num")
+	flow.GetAction("b").SetParam("output", "doubled=result")
+	runtime := andflow.ExecuteFlow(flow, map[string]interface{}{"num": 21}, 10000)
+	st := runtime.GetLastActionState("b")
+	if st == nil || fmt.Sprint(st.GetData("doubled")) != "42" || st.GetData("subflow_runtime_id") == nil {
+		t.Errorf("subflow output not mapped: %+v", st)
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("subflow parent state: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//子流程不存在
+	flow.GetAction("b").SetParam("flow_code", "subflow_none")
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if st := runtime.GetLastActionState("b"); st == nil || st.IsError != 1 {
+		t.Errorf("missing subflow should fail: %+v", st)
+	}
+
+	//父流程超时，同步执行的子流程一起结束
+	flow.GetAction("b").SetParam("flow_code", "subflow_slow")
+	begin := time.Now()
+	runtime = andflow.ExecuteFlow(flow, nil, 300)
+	if time.Since(begin) > 3*time.Second || runtime.FlowState != andflow.FLOW_STATE_TIMEOUT {
+		t.Errorf("sync subflow should stop with parent: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+
+	//异步执行，父流程不等待，超时后取消子流程
+	flow.GetAction("b").SetParam("mode", andflow.SUBFLOW_MODE_ASYNC)
+	flow.GetAction("c").Name = "test_slow"
+	flow.GetAction("c").SetParam("delay", "5s")
+	runtime = andflow.ExecuteFlow(flow, nil, 300)
+	childId := fmt.Sprint(runtime.GetLastActionState("b").GetData("subflow_runtime_id"))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := andflow.WaitSession(ctx, childId); err != nil {
+		t.Errorf("async subflow should be cancelled with parent: %v", err)
+	}
+
+	//子流程保存到父流程的存储中
+	store, err := andflow.OpenBoltRuntimeStore(path.Join(t.TempDir(), "runtime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	flow = andflow.CreateFlowModel("subflow_store", "父流程存储")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", andflow.SUBFLOW_RUNNER))
+	flow.Links = append(flow.Links, createLink("a", "b"))
+	flow.GetAction("b").SetParam("flow_code", "subflow_child")
+	runtime = andflow.CreateRuntime(flow, map[string]interface{}{"x": 1})
+	andflow.Execute(andflow.CreateStoreRuntimeOperation(store, runtime), &andflow.CommonFlowRouter{}, &andflow.CommonFlowRunner{}, 3000)
+	childId = fmt.Sprint(runtime.GetLastActionState("b").GetData("subflow_runtime_id"))
+	if saved, err := store.Get(childId); err != nil || saved.ParentId != runtime.Id || saved.Depth != 1 {
+		t.Errorf("subflow should be saved to parent store: %v", err)
+	}
+
+	//流程调用自身，超过最多嵌套层数后失败
+	recursive := andflow.CreateFlowModel("subflow_recursive", "递归子流程")
+	recursive.Actions = append(recursive.Actions, createAction("a", "begin"), createAction("b", andflow.SUBFLOW_RUNNER))
+	recursive.Links = append(recursive.Links, createLink("a", "b"))
+	recursive.GetAction("b").SetParam("flow_code", "subflow_recursive")
+	andflow.RegistFlow(recursive)
+	begin = time.Now()
+	runtime = andflow.ExecuteFlow(recursive, nil, 10000)
+	if time.Since(begin) > 3*time.Second || runtime.FlowState == andflow.FLOW_STATE_COMPLETED || runtime.GetLastActionState("b").IsError != 1 {
+		t.Errorf("recursive subflow should fail at max depth: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+}
+
+func TestFlowRepository(t *testing.T) {
+	dir := path.Join(os.TempDir(), fmt.Sprintf("andflow_repo_%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "sub"), 0755)
+	for _, version := range []string{"1.2", "1.10"} {
+		flow := andflow.CreateFlowModel("repo_flow", "流程仓库")
+		flow.Version = version
+		flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "end"))
+		flow.Links = append(flow.Links, createLink("a", "b"))
+		data, _ := json.Marshal(flow)
+		os.WriteFile(path.Join(dir, "sub", "repo_flow_"+version+".json"), data, 0644)
+	}
+	data, _ := os.ReadFile(path.Join(demo_path, "1简单流程.json"))
+	os.WriteFile(path.Join(dir, "simple.json"), data, 0644)
+
+	repo, err := andflow.LoadFlowDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := repo.Codes(); len(codes) != 2 || codes[0] != "repo_flow" || codes[1] != "simple" {
+		t.Errorf("flow codes: %v", codes)
+	}
+	if versions, _ := repo.Versions("repo_flow"); len(versions) != 2 || versions[1] != "1.10" {
+		t.Errorf("versions should be sorted: %v", versions)
+	}
+	if _, err := repo.Get("repo_flow", "3.0"); !errors.Is(err, andflow.ErrFlowNotFound) {
+		t.Errorf("missing version should return ErrFlowNotFound: %v", err)
+	}
+	if versions, _ := repo.Versions("simple"); len(versions) != 1 || versions[0] != andflow.FLOW_VERSION_DEFAULT {
+		t.Errorf("empty version should use default version: %v", versions)
+	}
+
+	andflow.SetFlowRepository(repo)
+	defer andflow.SetFlowRepository(nil)
+
+	//执行最新版本，运行时记录版本
+	runtime, err := andflow.ExecuteFlowByCode("repo_flow", andflow.FLOW_VERSION_LATEST, nil, 10000)
+	if err != nil || runtime.FlowCode != "repo_flow" || runtime.FlowVersion != "1.10" || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Fatalf("latest version not executed: %v", err)
+	}
+
+	//有新版本后，恢复的运行时仍然使用开始时的版本
+	runtime, _ = andflow.CreateRuntimeByCode("repo_flow", "1.2", nil)
+	newer := andflow.CreateFlowModel("repo_flow", "流程仓库")
+	newer.Version = "2.0"
+	if err := repo.Put(newer); err != nil {
+		t.Fatal(err)
+	}
+	runtime.Flow = nil
+	if err := andflow.LoadRuntimeFlow(nil, runtime); err != nil || runtime.Flow.Version != "1.2" {
+		t.Errorf("runtime should keep pinned version: %v", err)
+	}
+	if flow := andflow.GetFlowByCode("repo_flow"); flow == nil || flow.Version != "2.0" {
+		t.Errorf("latest version should be resolved")
+	}
+
+	//相同编码和版本不替换已有的流程
+	if err := repo.Put(andflow.CreateFlowModel("repo_flow", "重复版本")); err != nil {
+		t.Errorf("first unversioned flow should be added: %v", err)
+	}
+	duplicate := andflow.CreateFlowModel("repo_flow", "重复版本")
+	duplicate.Version = "2.0"
+	if err := repo.Put(duplicate); !errors.Is(err, andflow.ErrFlowExists) {
+		t.Errorf("duplicate version should return ErrFlowExists: %v", err)
+	}
+	if flow, _ := repo.Get("repo_flow", "2.0"); flow != newer {
+		t.Errorf("duplicate version should not replace existing flow")
+	}
+	duplicate.Version = andflow.FLOW_VERSION_LATEST
+	if err := repo.Put(duplicate); !errors.Is(err, andflow.ErrFlowVersion) {
+		t.Errorf("reserved version should return ErrFlowVersion: %v", err)
+	}
+
+	//没有记录版本的运行时恢复时使用默认版本，不使用最新版本
+	runtime = &andflow.RuntimeModel{FlowCode: "repo_flow"}
+	if err := andflow.LoadRuntimeFlow(repo, runtime); err != nil || runtime.Flow.Version != andflow.FLOW_VERSION_DEFAULT {
+		t.Errorf("unversioned runtime should load default version: %v", err)
+	}
+
+	//加载时有重复的版本返回错误
+	data, _ = os.ReadFile(path.Join(dir, "sub", "repo_flow_1.2.json"))
+	os.WriteFile(path.Join(dir, "repo_flow_copy.json"), data, 0644)
+	if _, err := andflow.LoadFlowDir(dir); !errors.Is(err, andflow.ErrFlowExists) {
+		t.Errorf("duplicate flow file should return ErrFlowExists: %v", err)
+	}
+}
+
+// 测试用执行器，记录执行的节点和迭代元素
+type recordActionRunner struct {
+	lock    sync.Mutex
+	records []string
+}
+
+func (r *recordActionRunner) Properties() []andflow.Prop {
+	return []andflow.Prop{}
+}
+
+func (r *recordActionRunner) Execute(s *andflow.Session, param *andflow.ActionParam, state *andflow.ActionStateModel) (andflow.Result, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, fmt.Sprintf("%s:%v", param.ActionId, s.GetParam("item")))
+	return andflow.RESULT_SUCCESS, nil
+}
+
+func TestGroupBlock(t *testing.T) {
+	andflow.RegistActionRunner("test_slow", &slowActionRunner{})
+	recorder := &recordActionRunner{}
+	andflow.RegistActionRunner("test_record", recorder)
+
+	//组内的节点都完成后才离开组
+	flow := andflow.CreateFlowModel("group_block", "组")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_slow"), createAction("c", "script"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("a", "c"), createLink("c", "d"))
+	flow.GetAction("b").Params["delay"] = "200"
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"b", "c"}})
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	b, d := runtime.GetLastActionState("b"), runtime.GetLastActionState("d")
+	if b == nil || d == nil || d.BeginTime.Before(b.EndTime) {
+		t.Errorf("group should exit after all members finish")
+	}
+	if b != nil && b.GroupId != "g" {
+		t.Errorf("group id not recorded: %s", b.GroupId)
+	}
+
+	//按照列表参数迭代执行组
+	flow = andflow.CreateFlowModel("group_iterate", "组迭代")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_record"), createAction("c", "test_record"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "d"))
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"b", "c"}, IteratorList: "items", IteratorItem: "item"})
+	runtime = andflow.ExecuteFlow(flow, map[string]interface{}{"items": []interface{}{"x", "y", "z"}}, 10000)
+	if fmt.Sprint(recorder.records) != "[b:x c:x b:y c:y b:z c:z]" {
+		t.Errorf("group iteration order: %v", recorder.records)
+	}
+	iterations := make([]int, 0)
+	for _, st := range runtime.ActionStates {
+		if st.ActionId == "b" {
+			iterations = append(iterations, st.Iteration)
+		}
+	}
+	if fmt.Sprint(iterations) != "[1 2 3]" {
+		t.Errorf("iteration not recorded on states: %v", iterations)
+	}
+	if executed, _ := countActionStates(runtime, "d"); executed != 1 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("group should exit once after iteration: %d", executed)
+	}
+
+	//组超时后按照离开组的错误路径执行
+	flow = andflow.CreateFlowModel("group_timeout", "组超时")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_slow"), createAction("c", "test_slow"), createAction("d", "end"), createAction("e", "test_script"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "d"), createLink("b", "e"))
+	flow.GetAction("b").Params["delay"] = "100"
+	flow.GetAction("c").Params["delay"] = "1000"
+	flow.GetAction("e").ScriptAfter = `var e = getError(); setParam("runner", e.runner); setParam("timeout", e.is_timeout);`
+	flow.GetLinkBySourceIdAndTargetId("b", "e").On = andflow.LINK_ON_ERROR
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"b", "c"}, Timeout: "300"})
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, _ := countActionStates(runtime, "d"); executed != 0 {
+		t.Errorf("success exit should not be followed after group timeout")
+	}
+	if runtime.GetParam("runner") != "group" || fmt.Sprint(runtime.GetParam("timeout")) != "1" {
+		t.Errorf("group error not passed to error exit: %v", runtime.GetParamMap())
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_COMPLETED || runtime.IsError != 0 {
+		t.Errorf("handled group timeout runtime state: %s %d", andflow.GetFlowStateName(runtime.FlowState), runtime.IsError)
+	}
+
+	//组内节点拒绝执行时组不结束，下次执行时继续
+	flow = andflow.CreateFlowModel("group_wait", "组等待")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "script"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "d"))
+	flow.GetAction("b").ScriptBefore = "return 0"
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"b", "c"}})
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, skipped := countActionStates(runtime, "d"); executed != 0 || skipped != 0 || runtime.FlowState != andflow.FLOW_STATE_WAITING {
+		t.Errorf("group should wait for rejected member: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+	flow.GetAction("b").ScriptBefore = "return 1"
+	runtime = andflow.ExecuteRuntime(runtime, 10000)
+	if executed, _ := countActionStates(runtime, "d"); executed != 1 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("group should exit after waiting member runs: %d", executed)
+	}
+
+	//有两个进入组的路径时，都到达后进入一次组
+	for _, filter := range []string{"", "return 0"} {
+		flow = andflow.CreateFlowModel("group_entry", "组汇聚")
+		flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_slow"), createAction("c", "script"), createAction("x", "script"), createAction("y", "script"), createAction("d", "end"))
+		flow.Links = append(flow.Links, createLink("a", "b"), createLink("a", "c"), createLink("b", "x"), createLink("c", "x"), createLink("x", "y"), createLink("y", "d"))
+		flow.GetAction("b").Params["delay"] = "200"
+		flow.GetLinkBySourceIdAndTargetId("c", "x").Filter = filter
+		flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"x", "y"}})
+		runtime = andflow.ExecuteFlow(flow, nil, 10000)
+		x := runtime.GetLastActionState("x")
+		if executed, _ := countActionStates(runtime, "x"); executed != 1 || x.BeginTime.Before(runtime.GetLastActionState("b").EndTime) {
+			t.Errorf("group should be entered once after all entry links arrive (%q): %d", filter, executed)
+		}
+		if executed, _ := countActionStates(runtime, "d"); executed != 1 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+			t.Errorf("group with two entry links should exit once (%q): %d", filter, executed)
+		}
+	}
+
+	//组执行期间再次到达进入组的路径，组结束后再次进入
+	flow = andflow.CreateFlowModel("group_reenter", "组再次进入")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "script"), createAction("e", "end"), createAction("x", "script"), createAction("y", "test_slow"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "x"), createLink("b", "c"), createLink("c", "b"), createLink("c", "e"), createLink("x", "y"), createLink("y", "d"))
+	flow.GetAction("y").Params["delay"] = "300"
+	flow.GetAction("c").Gateway = andflow.GATEWAY_EXCLUSIVE
+	flow.GetLinkBySourceIdAndTargetId("c", "b").Filter = `var n = (getParam("n") || 0) + 1; setParam("n", n); return n < 2 ? 1 : 0`
+	flow.GetLinkBySourceIdAndTargetId("c", "e").Default = "true"
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"x", "y"}})
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	xs := make([]*andflow.ActionStateModel, 0)
+	for _, st := range runtime.ActionStates {
+		if st.ActionId == "x" {
+			xs = append(xs, st)
+		}
+	}
+	if len(xs) != 2 || xs[1].BeginTime.Before(runtime.GetActionStates("y")[0].EndTime) {
+		t.Errorf("entry arriving while group runs should enter after group finishes: %d", len(xs))
+	}
+	if executed, _ := countActionStates(runtime, "d"); executed != 2 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED || len(runtime.RunningActions) != 0 {
+		t.Errorf("group should exit once per entry: %d %s", executed, andflow.GetFlowStateName(runtime.FlowState))
+	}
+}
+
+func TestLoop(t *testing.T) {
+	andflow.RegistActionRunner("test_script", &andflow.ScriptActionRunner{})
+	recorder := &recordActionRunner{}
+	andflow.RegistActionRunner("test_record", recorder)
+
+	//until循环，执行后满足条件时结束
+	flow := andflow.CreateFlowModel("loop_until", "until循环")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_script"), createAction("c", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"))
+	flow.GetAction("b").ScriptAfter = `setParam("count", getIteration())`
+	flow.GetAction("b").Loop = andflow.LOOP_UNTIL
+	flow.GetAction("b").LoopCondition = `return getIteration() >= 3`
+	runtime := andflow.ExecuteFlow(flow, nil, 10000)
+	if fmt.Sprint(runtime.GetParam("count")) != "3" {
+		t.Errorf("until loop count: %v", runtime.GetParam("count"))
+	}
+	if states := runtime.GetIterationStates("b"); len(states) != 3 || states[2][0].LoopIndex != 3 {
+		t.Errorf("loop states not grouped: %d", len(states))
+	}
+	if executed, _ := countActionStates(runtime, "c"); executed != 1 || runtime.FlowState != andflow.FLOW_STATE_COMPLETED {
+		t.Errorf("next action should run once after loop: %d", executed)
+	}
+
+	//排他路由的循环节点，循环结束后才判断路径
+	gateway := createGatewayFlow("loop_gateway", "", `var n = (getParam("routed") || 0) + 1; setParam("routed", n); return 1`)
+	gateway.GetAction("a").Loop = andflow.LOOP_UNTIL
+	gateway.GetAction("a").LoopCondition = `return getIteration() >= 3`
+	runtime = andflow.ExecuteFlow(gateway, nil, 10000)
+	if fmt.Sprint(runtime.GetParam("routed")) != "1" || runtime.GetLastActionState("c") == nil {
+		t.Errorf("looping gateway should route once after loop: %v", runtime.GetParam("routed"))
+	}
+
+	//while循环，第一次不满足条件时不执行，直接执行后续路径
+	flow.GetAction("b").Loop = andflow.LOOP_WHILE
+	flow.GetAction("b").LoopCondition = `return getParam("n") > 0`
+	runtime = andflow.ExecuteFlow(flow, map[string]interface{}{"n": 0}, 10000)
+	if runtime.GetParam("count") != nil || runtime.GetLastActionState("c") == nil {
+		t.Errorf("while loop should not run when condition is false")
+	}
+
+	//组的while循环，每次迭代的执行记录按照迭代分组
+	flow = andflow.CreateFlowModel("loop_group", "组循环")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "test_record"), createAction("c", "test_script"), createAction("d", "end"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "d"))
+	flow.GetAction("c").ScriptAfter = `setParam("round", getIteration())`
+	flow.Groups = append(flow.Groups, &andflow.GroupModel{Id: "g", Members: []string{"b", "c"}, Loop: andflow.LOOP_WHILE, LoopCondition: `return getIteration() <= 2`})
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if states := runtime.GetIterationStates("g"); len(states) != 2 || len(states[0]) != 2 || len(states[1]) != 2 {
+		t.Errorf("group loop states not grouped: %d", len(states))
+	}
+	if fmt.Sprint(runtime.GetParam("round")) != "2" {
+		t.Errorf("iteration not available to scripts: %v", runtime.GetParam("round"))
+	}
+	if executed, _ := countActionStates(runtime, "d"); executed != 1 {
+		t.Errorf("group loop should exit once: %d", executed)
+	}
+
+	//超过最多执行次数时流程失败
+	flow = andflow.CreateFlowModel("loop_visits", "最多执行次数")
+	flow.Actions = append(flow.Actions, createAction("a", "begin"), createAction("b", "script"), createAction("c", "script"))
+	flow.Links = append(flow.Links, createLink("a", "b"), createLink("b", "c"), createLink("c", "b"))
+	flow.GetAction("b").MaxVisits = 3
+	runtime = andflow.ExecuteFlow(flow, nil, 10000)
+	if executed, _ := countActionStates(runtime, "b"); executed != 4 {
+		t.Errorf("action visits: %d", executed)
+	}
+	if st := runtime.GetLastActionState("b"); st == nil || st.IsError != 1 {
+		t.Errorf("exceeded action should fail")
+	}
+	if runtime.FlowState != andflow.FLOW_STATE_FAILED {
+		t.Errorf("runtime should fail when max visits exceeded: %s", andflow.GetFlowStateName(runtime.FlowState))
+	}
+}